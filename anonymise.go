@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+/// Pseudonymises personal data in free text for migrations into shared test
+/// instances. Users themselves only go to Jiskefet as IDs. Pseudonyms are
+/// derived from a keyed hash, so the same input always maps to the same
+/// pseudonym for a given key, and thread structure, timestamps and tags are
+/// left untouched.
+type Anonymiser struct {
+	key         []byte
+	attachments bool              // Replace attachment contents with placeholders
+	identities  map[string]string // Lowercase known name/username/email -> pseudonym
+	pattern     *regexp.Regexp    // Matches any of the known identities
+}
+
+func newAnonymiser(key string, users []logbook.User, attachments bool) *Anonymiser {
+	if key == "" {
+		log.Printf("WARNING: No anonymisation key set, email addresses can be recovered from their pseudonyms by guessing them\n")
+	}
+	a := &Anonymiser{
+		key:         []byte(key),
+		attachments: attachments,
+		identities:  make(map[string]string),
+	}
+
+	// Collect everything in the users table that could identify someone in
+	// free text. Their pseudonyms only depend on the user ID.
+	for _, user := range users {
+		id := fmt.Sprintf("%d", user.ID.Int64)
+		a.addIdentity(user.Email.String, a.pseudonym("user", id)+"@example.invalid")
+		a.addIdentity(user.FullName.String, a.pseudonym("name", id))
+		a.addIdentity(user.Username.String, a.pseudonym("user", id))
+		a.addIdentity(user.FirstName.String, a.pseudonym("first", id))
+	}
+	if len(a.identities) > 0 {
+		// Longest first, so "John Smith" is replaced before "John"
+		quoted := make([]string, 0, len(a.identities))
+		for identity := range a.identities {
+			quoted = append(quoted, regexp.QuoteMeta(identity))
+		}
+		sort.Slice(quoted, func(i, j int) bool {
+			if len(quoted[i]) != len(quoted[j]) {
+				return len(quoted[i]) > len(quoted[j])
+			}
+			return quoted[i] < quoted[j]
+		})
+		a.pattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return a
+}
+
+func (a *Anonymiser) addIdentity(identity string, pseudonym string) {
+	identity = strings.TrimSpace(identity)
+	// Very short names match too many ordinary words to be worth scrubbing
+	if len(identity) < 3 {
+		return
+	}
+	a.identities[strings.ToLower(identity)] = pseudonym
+}
+
+/// Returns a deterministic pseudonym for the value, e.g. "user-3fa94c1b02"
+func (a *Anonymiser) pseudonym(kind string, value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind + ":" + value))
+	return kind + "-" + hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+/// Scrubs known names and any email addresses from free text
+func (a *Anonymiser) Text(text string) string {
+	if a.pattern != nil {
+		text = a.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			return a.identities[strings.ToLower(match)]
+		})
+	}
+	return emailPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if strings.HasSuffix(match, "@example.invalid") {
+			return match // Already a pseudonym
+		}
+		return a.pseudonym("email", strings.ToLower(match)) + "@example.invalid"
+	})
+}
+
+/// Scrubs the title and body of a comment
+func (a *Anonymiser) Comment(comment logbook.Comment) logbook.Comment {
+	comment.Title.String = a.Text(comment.Title.String)
+	comment.Comment.String = a.Text(comment.Comment.String)
+	return comment
+}
+
+/// Scrubs the attachment metadata, and replaces the contents with a
+/// placeholder if attachment anonymisation is enabled
+func (a *Anonymiser) File(file logbook.File, data []byte) (logbook.File, []byte) {
+	file.Title.String = a.Text(file.Title.String)
+	if !a.attachments {
+		file.FileName.String = a.Text(file.FileName.String)
+		return file, data
+	}
+	placeholder := fmt.Sprintf("Attachment %d of comment %d removed by anonymisation (%s, %d bytes)\n",
+		file.FileID.Int64, file.CommentID.Int64, file.ContentType.String, len(data))
+	file.FileName.String = fmt.Sprintf("attachment_%d_%d.txt", file.CommentID.Int64, file.FileID.Int64)
+	file.ContentType.String = "text/plain"
+	file.Size.Int64 = int64(len(placeholder))
+	return file, []byte(placeholder)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+// Kinds of problems the audit finds in the logbook data
+const (
+	auditOrphanParent     = "orphanParent"     // Comment's parent does not exist
+	auditOrphanRoot       = "orphanRoot"       // Comment's root parent does not exist
+	auditInconsistentRoot = "inconsistentRoot" // Root parent is not the root of the parent chain
+	auditCycle            = "cycle"            // Parent chain loops
+	auditUnknownUser      = "unknownUser"      // Comment author not in logbook_users
+	auditUnknownSubsystem = "unknownSubsystem" // Comment filed under a subsystem not in logbook_subsystems
+	auditMissingFile      = "missingFile"      // logbook_files row without the file on disk
+	auditEmptyTitle       = "emptyTitle"       // Comment without title
+	auditEmptyBody        = "emptyBody"        // Comment without body
+	auditInvalidTimestamp = "invalidTimestamp" // Timestamp that doesn't parse, or MySQL's zero date
+)
+
+/// What the audit found, so it can be fixed in the logbook before the
+/// migration is scheduled
+type AuditReport struct {
+	Generated string         `json:"generated"`
+	Counts    map[string]int `json:"counts"` // Kind -> number of issues
+	Issues    []AuditIssue   `json:"issues"`
+}
+
+/// One problem in a row of the logbook
+type AuditIssue struct {
+	Kind   string `json:"kind"`
+	Table  string `json:"table"`
+	ID     int64  `json:"id"` // Comment ID, or file ID for logbook_files
+	Detail string `json:"detail"`
+}
+
+func (report *AuditReport) add(kind string, table string, id int64, format string, values ...interface{}) {
+	report.Counts[kind]++
+	report.Issues = append(report.Issues, AuditIssue{
+		Kind:   kind,
+		Table:  table,
+		ID:     id,
+		Detail: fmt.Sprintf(format, values...),
+	})
+}
+
+/// Checks that a logbook timestamp is a real time
+func validTimestamp(timestamp string) bool {
+	parsed, err := time.Parse(logbook.TimestampFormat, timestamp)
+	return err == nil && !parsed.IsZero()
+}
+
+/// Follows the parents of the comment up to the thread root. Returns the root,
+/// or 0 if a parent is missing, and the comments of the loop if there is one.
+func threadRoot(comments map[int64]logbook.Comment, id int64) (int64, []int64) {
+	seen := make(map[int64]int) // Comment ID -> position in path
+	path := make([]int64, 0)
+	for current := id; ; {
+		if position, exists := seen[current]; exists {
+			return 0, path[position:]
+		}
+		seen[current] = len(path)
+		path = append(path, current)
+
+		comment, exists := comments[current]
+		if !exists {
+			return 0, nil
+		}
+		if !comment.Parent.Valid {
+			return current, nil
+		}
+		current = comment.Parent.Int64
+	}
+}
+
+/// Scans the logbook for data the migration would choke on or migrate wrongly
+func auditLogbook(args Args, source logbook.Source) *AuditReport {
+	report := &AuditReport{
+		Generated: time.Now().UTC().Format(time.RFC3339),
+		Counts:    make(map[string]int),
+		Issues:    make([]AuditIssue, 0),
+	}
+
+	comments := make(map[int64]logbook.Comment)
+	for _, comment := range source.Comments() {
+		comments[comment.ID.Int64] = comment
+	}
+	users := make(map[int64]bool)
+	for _, user := range source.Users() {
+		users[user.ID.Int64] = true
+	}
+	subsystems := logbook.SubsystemsMap(source)
+
+	ids := make([]int64, 0, len(comments))
+	for id := range comments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	reportedCycles := make(map[int64]bool) // Lowest comment ID of every cycle reported
+	for _, id := range ids {
+		comment := comments[id]
+
+		if comment.Parent.Valid {
+			if _, exists := comments[comment.Parent.Int64]; !exists {
+				report.add(auditOrphanParent, "logbook_comments", id, "parent %d does not exist", comment.Parent.Int64)
+			}
+		}
+		if comment.RootParent.Valid {
+			if _, exists := comments[comment.RootParent.Int64]; !exists {
+				report.add(auditOrphanRoot, "logbook_comments", id, "root parent %d does not exist", comment.RootParent.Int64)
+			}
+		}
+
+		root, cycle := threadRoot(comments, id)
+		if len(cycle) > 0 {
+			lowest := cycle[0]
+			for _, cycleID := range cycle {
+				if cycleID < lowest {
+					lowest = cycleID
+				}
+			}
+			if !reportedCycles[lowest] {
+				reportedCycles[lowest] = true
+				report.add(auditCycle, "logbook_comments", lowest, "parents loop through comments %s", joinIDs(cycle))
+			}
+		} else if root != 0 && comment.RootParent.Valid && comment.RootParent.Int64 != root {
+			report.add(auditInconsistentRoot, "logbook_comments", id, "root parent is %d, but the thread root is %d",
+				comment.RootParent.Int64, root)
+		} else if root != 0 && root != id && !comment.RootParent.Valid {
+			report.add(auditInconsistentRoot, "logbook_comments", id, "no root parent, but the thread root is %d", root)
+		}
+
+		if !comment.UserID.Valid {
+			report.add(auditUnknownUser, "logbook_comments", id, "no user")
+		} else if !users[comment.UserID.Int64] {
+			report.add(auditUnknownUser, "logbook_comments", id, "user %d does not exist", comment.UserID.Int64)
+		}
+
+		if strings.TrimSpace(comment.Title.String) == "" {
+			report.add(auditEmptyTitle, "logbook_comments", id, "empty title")
+		}
+		if strings.TrimSpace(comment.Comment.String) == "" {
+			report.add(auditEmptyBody, "logbook_comments", id, "empty body")
+		}
+
+		if !validTimestamp(comment.TimeCreated.String) {
+			report.add(auditInvalidTimestamp, "logbook_comments", id, "creation time \"%s\"", comment.TimeCreated.String)
+		}
+		if comment.TimeValidity.Valid && !validTimestamp(comment.TimeValidity.String) {
+			report.add(auditInvalidTimestamp, "logbook_comments", id, "validity time \"%s\"", comment.TimeValidity.String)
+		}
+	}
+
+	for _, link := range source.SubsystemLinks() {
+		if _, exists := subsystems[link.SubsystemID.Int64]; !exists {
+			report.add(auditUnknownSubsystem, "logbook_comments_subsystems", link.CommentID.Int64,
+				"subsystem %d does not exist", link.SubsystemID.Int64)
+		}
+	}
+
+	for _, file := range source.Files() {
+		if !validTimestamp(file.TimeCreated.String) {
+			report.add(auditInvalidTimestamp, "logbook_files", file.FileID.Int64, "creation time \"%s\"", file.TimeCreated.String)
+		}
+		path, err := attachmentPath(args.logbookFilesDir, file)
+		if err != nil {
+			report.add(auditMissingFile, "logbook_files", file.FileID.Int64, "%s", err)
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			report.add(auditMissingFile, "logbook_files", file.FileID.Int64, "comment %d: %s", file.CommentID.Int64, err)
+		}
+	}
+
+	return report
+}
+
+func joinIDs(ids []int64) string {
+	texts := make([]string, len(ids))
+	for i, id := range ids {
+		texts[i] = fmt.Sprintf("%d", id)
+	}
+	return strings.Join(texts, " -> ")
+}
+
+/// Writes the report for people: a summary per kind, then the issues per kind
+func (report *AuditReport) writeText(w io.Writer) {
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	fmt.Fprintf(w, "Logbook audit, %s: %d issues\n", report.Generated, len(report.Issues))
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-20s %d\n", kind, report.Counts[kind])
+	}
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "\n%s:\n", kind)
+		for _, issue := range report.Issues {
+			if issue.Kind == kind {
+				fmt.Fprintf(w, "  %s %d: %s\n", issue.Table, issue.ID, issue.Detail)
+			}
+		}
+	}
+}
+
+/// Prints the report for people, and writes it as JSON to path
+func (report *AuditReport) write(path string) {
+	report.writeText(os.Stdout)
+	data, err := json.MarshalIndent(report, "", "  ")
+	check(err)
+	check(ioutil.WriteFile(path, data, 0644))
+	log.Printf("Wrote audit report to \"%s\"\n", path)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+/// Every migrated log gets this tag followed by its batch ID
+const batchTagPrefix = "MIGRATION/"
+
+var batchIDPattern = regexp.MustCompile(`^[A-Za-z0-9_\-.:]{1,64}$`)
+
+/// A migration run, as recorded in the Jiskefet DB so any migrated log can be
+/// traced back to the run that created it
+type batchInfo struct {
+	ID       string `json:"id"`
+	Started  string `json:"started"`
+	Finished string `json:"finished,omitempty"`
+	Status   string `json:"status"` // "running", "finished", "failed" or "rolled back"
+	Flags    string `json:"flags"`  // The command and the flags that were set
+	SourceDB string `json:"sourceDb"`
+	Counts   string `json:"counts,omitempty"` // JSON of batchCounts
+	Version  string `json:"version"`
+	Operator string `json:"operator"`
+}
+
+/// What a batch migrated
+type batchCounts struct {
+	Logs        int `json:"logs"`
+	Attachments int `json:"attachments"`
+	TagLinks    int `json:"tagLinks"`
+	Runs        int `json:"runs"`
+	Users       int `json:"users"`
+	Subsystems  int `json:"subsystems"`
+}
+
+/// Implemented by targets that can keep a record of migration batches
+type batchRecorder interface {
+	StartBatch(batch batchInfo) error
+	FinishBatch(batch batchInfo) error
+}
+
+/// Returns the batch ID to use: the given one, or the start time
+func newBatchID(batchID string) string {
+	if batchID == "" {
+		batchID = time.Now().UTC().Format("20060102T150405Z")
+	}
+	if !batchIDPattern.MatchString(batchID) {
+		panic(fmt.Sprintf("Invalid batch ID \"%s\", use up to 64 letters, digits and _-.:", batchID))
+	}
+	return batchID
+}
+
+/// Returns the tag that marks logs of the batch
+func batchTagText(batchID string) string {
+	return batchTagPrefix + batchID
+}
+
+/// Returns the flags that were set, as they would be given on the command line
+func setFlags(flagSet *flag.FlagSet) string {
+	flags := make([]string, 0)
+	flagSet.Visit(func(f *flag.Flag) {
+		flags = append(flags, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	return strings.Join(flags, " ")
+}
+
+/// Returns who runs the migration: JISKEFET_MIGRATE_OPERATOR, or the login name
+func operator() string {
+	for _, name := range []string{"JISKEFET_MIGRATE_OPERATOR", "USER", "USERNAME"} {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return "unknown"
+}
+
+func newBatchInfo(args Args, commandLine string) batchInfo {
+	return batchInfo{
+		ID:       args.batchID,
+		Started:  time.Now().UTC().Format(logbook.TimestampFormat),
+		Status:   "running",
+		Flags:    commandLine,
+		SourceDB: fmt.Sprintf("%s/%s", args.logbookDB.hostPort, args.logbookDB.dbName),
+		Version:  version,
+		Operator: operator(),
+	}
+}
+
+/// Records the start of the batch in the target, if it can
+func startBatch(target Target, batch batchInfo) {
+	recorder, ok := target.(batchRecorder)
+	if !ok {
+		log.Printf("WARNING: Target can't record batches, batch \"%s\" is only in the tags\n", batch.ID)
+		return
+	}
+	check(recorder.StartBatch(batch))
+	log.Printf("Started batch \"%s\"\n", batch.ID)
+}
+
+/// Records the end of the batch in the target, with what it migrated
+func finishBatch(target Target, batch batchInfo, report *Report, status string) {
+	recorder, ok := target.(batchRecorder)
+	if !ok {
+		return
+	}
+	counts, err := json.Marshal(report.counts())
+	check(err)
+	batch.Finished = time.Now().UTC().Format(logbook.TimestampFormat)
+	batch.Status = status
+	batch.Counts = string(counts)
+	if err := recorder.FinishBatch(batch); err != nil {
+		log.Printf("WARNING: Could not record the end of batch \"%s\": %s\n", batch.ID, err)
+		return
+	}
+	log.Printf("Batch \"%s\" %s: %s\n", batch.ID, status, batch.Counts)
+}
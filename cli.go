@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+	httptransport "github.com/go-openapi/runtime/client"
+)
+
+// Migration stages, in the order they run
+const (
+	stageSubsystems = "subsystems"
+	stageUsers      = "users"
+	stageRuns       = "runs"
+	stageComments   = "comments"
+	stageUpdate     = "update" // Edits to migrated comments, only when given
+	stageAll        = "all"    // All of the above but update
+)
+
+var stageOrder = []string{stageSubsystems, stageUsers, stageRuns, stageComments, stageUpdate}
+
+/// The stages of "all"
+var allStages = []string{stageSubsystems, stageUsers, stageRuns, stageComments}
+
+/// Stages that should have run before a stage, in this run or an earlier one
+var stageDependencies = map[string][]string{
+	stageComments: {stageUsers},      // Authors
+	stageUpdate:   {stageComments},   // What there is to update
+	"sync":        {stageSubsystems}, // Sync does everything else itself
+}
+
+// Groups of command line flags, a command or stage takes the groups it uses
+const (
+	flagsLogbook       = "logbook"       // Reading the logbook
+	flagsTarget        = "target"        // Writing to Jiskefet
+	flagsIDMap         = "idmap"         // Keeping track of migrated IDs
+	flagsSubsystemTree = "subsystemtree" // Subsystem hierarchy, for subsystems and subsystem tags
+	flagsConflicts     = "conflicts"     // Users and subsystems that exist already
+	flagsSubscriptions = "subscriptions"
+	flagsUserMerge     = "usermerge"
+	flagsRuns          = "runs"
+	flagsTags          = "tags"     // Tags of comments
+	flagsTagCache      = "tagcache" // Tag IDs kept between runs
+	flagsThreads       = "threads"  // How comment threads are migrated
+	flagsFilters       = "filters"  // Which comment threads
+	flagsSync          = "sync"
+	flagsRollback      = "rollback"
+	flagsOut           = "out"
+)
+
+var stageFlags = map[string][]string{
+	stageSubsystems: {flagsSubsystemTree, flagsConflicts, flagsSubscriptions},
+	stageUsers:      {flagsUserMerge, flagsConflicts},
+	stageRuns:       {flagsRuns},
+	stageComments:   {flagsSubsystemTree, flagsUserMerge, flagsTags, flagsTagCache, flagsThreads, flagsFilters},
+	stageUpdate:     {flagsSubsystemTree, flagsTags},
+}
+
+/// The values of all command line flags. A command only registers the flags
+/// it uses, the others keep their defaults.
+type cliOptions struct {
+	configPath           string
+	profile              string
+	configSets           configOverrides
+	tlsSkipVerify        bool
+	allowUnknownEnums    bool
+	target               string
+	targetFile           string
+	batchID              string
+	reportFile           string
+	anonymise            bool
+	anonymiseAttachments bool
+	idMapFile            string
+	subsystemTags        string
+	obsoleteSubsystems   string
+	subsystemRemapFile   string
+	onConflict           string
+	exportSubscriptions  string
+	userMergeFile        string
+	userMergeAuto        bool
+	runMin               string
+	runMax               string
+	runLimit             string
+	tagRulesFile         string
+	tagCacheFile         string
+	strictTags           bool
+	parallel             bool
+	orphans              string
+	filter               commentFilterFlags
+	update               bool
+	syncInterval         time.Duration
+	syncPendingFor       time.Duration
+	rollbackCreated      bool
+	dryRun               bool
+	out                  string
+	commandLine          string // The command, its arguments and the flags that were set, for the batch record
+}
+
+func newCLIOptions() *cliOptions {
+	return &cliOptions{
+		configPath:         os.Getenv("JISKEFET_MIGRATE_CONFIG"),
+		profile:            os.Getenv("JISKEFET_MIGRATE_PROFILE"),
+		target:             targetJiskefet,
+		targetFile:         "migration.jsonl",
+		subsystemTags:      subsystemTagsLeaf,
+		obsoleteSubsystems: obsoleteKeep,
+		onConflict:         conflictKeep,
+		runMin:             "500",
+		runMax:             "9999999",
+		runLimit:           "10",
+		orphans:            orphansQuarantine,
+		syncInterval:       time.Minute,
+		syncPendingFor:     time.Hour,
+	}
+}
+
+/// Registers the flags of the groups, each group once
+func (options *cliOptions) addFlags(flags *flag.FlagSet, groups ...string) {
+	added := make(map[string]bool)
+	for _, group := range groups {
+		if added[group] {
+			continue
+		}
+		added[group] = true
+		switch group {
+		case flagsLogbook:
+			flags.BoolVar(&options.allowUnknownEnums, "allowunknownenums", options.allowUnknownEnums,
+				"Migrate comment types, classes & contexts the migrator doesn't know as they are")
+		case flagsTarget:
+			flags.StringVar(&options.target, "target", options.target,
+				"Where to migrate to: \"jiskefet\" (API + DB), \"api\" (API only), \"db\" (Jiskefet DB only) or \"file\"")
+			flags.StringVar(&options.targetFile, "targetfile", options.targetFile, "With -target file: the JSON-lines file to write")
+			flags.StringVar(&options.batchID, "batch", options.batchID,
+				"ID of this migration run, recorded in Jiskefet, the logs' tags and the ID map, default the start time")
+			flags.StringVar(&options.reportFile, "report", options.reportFile, "Write a JSON report of problems during the migration to this file")
+			flags.BoolVar(&options.anonymise, "anonymise", options.anonymise,
+				"Pseudonymise users and scrub names & emails from comments, for test instances")
+			flags.BoolVar(&options.anonymiseAttachments, "anonymiseattachments", options.anonymiseAttachments,
+				"With -anonymise: replace attachment contents with placeholders")
+		case flagsIDMap:
+			flags.StringVar(&options.idMapFile, "idmap", options.idMapFile,
+				"Keep track of migrated logbook IDs and their Jiskefet IDs in this JSON file")
+		case flagsSubsystemTree:
+			flags.StringVar(&options.subsystemTags, "subsystemtags", options.subsystemTags,
+				"Subsystems: Hierarchy in tags, \"leaf\" (own name), \"path\" (e.g. ITS/SPD) or \"ancestors\" (own name + all parents)")
+			flags.StringVar(&options.obsoleteSubsystems, "obsoletesubsystems", options.obsoleteSubsystems,
+				"Subsystems: Obsolete subsystems are \"keep\" (migrated as-is), \"skip\", \"remap\" (onto successor) or \"prefix\" (with OBSOLETE/)")
+			flags.StringVar(&options.subsystemRemapFile, "subsystemremap", options.subsystemRemapFile,
+				"Subsystems: JSON file mapping obsolete subsystem names to successors")
+		case flagsConflicts:
+			flags.StringVar(&options.onConflict, "onconflict", options.onConflict,
+				"Users & subsystems: When Jiskefet has them already with other data, \"keep\" Jiskefet's, \"overwrite\" it or \"fail\"")
+		case flagsSubscriptions:
+			flags.StringVar(&options.exportSubscriptions, "subscriptions", options.exportSubscriptions,
+				"Subsystems: Export subsystem notification settings to this JSON file")
+		case flagsUserMerge:
+			flags.StringVar(&options.userMergeFile, "usermerge", options.userMergeFile, "Users: JSON file with explicit list of users to merge")
+			flags.BoolVar(&options.userMergeAuto, "usermergeauto", options.userMergeAuto, "Users: Merge users with the same email or full name")
+		case flagsRuns:
+			flags.StringVar(&options.runMin, "rmin", options.runMin, "Runs: Lower run number bound")
+			flags.StringVar(&options.runMax, "rmax", options.runMax, "Runs: Upper run number bound")
+			flags.StringVar(&options.runLimit, "rlimit", options.runLimit, "Runs: Query result size limit")
+		case flagsTags:
+			flags.StringVar(&options.tagRulesFile, "tagrules", options.tagRulesFile, "Comments: JSON file with tag naming and mapping rules")
+			flags.BoolVar(&options.strictTags, "stricttags", options.strictTags, "Comments: Verify that every tag link exists after linking it")
+		case flagsTagCache:
+			flags.StringVar(&options.tagCacheFile, "tagcache", options.tagCacheFile, "File to persist the tag ID cache in between runs")
+		case flagsThreads:
+			flags.BoolVar(&options.parallel, "parallel", options.parallel, "Comments: Migrate threads in parallel")
+			flags.StringVar(&options.orphans, "orphans", options.orphans,
+				"Comments: Comments with a missing parent or in a parent loop are \"promote\"d to a thread root, attached to their \"root\" parent or \"quarantine\"d (not migrated)")
+		case flagsFilters:
+			filter := &options.filter
+			flags.StringVar(&filter.from, "cfrom", filter.from, "Comments: Only threads created from this date (YYYY-MM-DD[ hh:mm:ss])")
+			flags.StringVar(&filter.to, "cto", filter.to, "Comments: Only threads created up to this date (YYYY-MM-DD[ hh:mm:ss])")
+			flags.Int64Var(&filter.runMin, "crunmin", filter.runMin, "Comments: Only threads about runs from this run number")
+			flags.Int64Var(&filter.runMax, "crunmax", filter.runMax, "Comments: Only threads about runs up to this run number")
+			flags.StringVar(&filter.users, "cusers", filter.users, "Comments: Only threads by these comma separated logbook user IDs")
+			flags.StringVar(&filter.subsystems, "csubsystems", filter.subsystems, "Comments: Only threads filed under these comma separated subsystem names, or below them")
+			flags.StringVar(&filter.types, "ctypes", filter.types, "Comments: Only threads of these comma separated comment types")
+			flags.StringVar(&filter.classes, "cclasses", filter.classes, "Comments: Only threads of these comma separated classes")
+			flags.StringVar(&filter.contexts, "ccontexts", filter.contexts, "Comments: Only threads of these comma separated contexts")
+			flags.StringVar(&filter.threads, "cthreads", filter.threads, "Comments: Only the threads with these comma separated root comment IDs")
+			flags.BoolVar(&filter.anyMember, "cmatchany", filter.anyMember, "Comments: Select a thread if any comment in it matches the filters, not just its root")
+		case flagsSync:
+			flags.BoolVar(&options.update, "update", options.update, "Also carry edits to already migrated comments over to Jiskefet every pass")
+			flags.DurationVar(&options.syncInterval, "interval", options.syncInterval, "Time between sync passes")
+			flags.DurationVar(&options.syncPendingFor, "pendingfor", options.syncPendingFor,
+				"How long replies to comments that are not migrated are retried before they are given up")
+		case flagsRollback:
+			flags.BoolVar(&options.rollbackCreated, "created", options.rollbackCreated, "Also delete the tags, users and subsystems the batch created")
+			flags.BoolVar(&options.dryRun, "dryrun", options.dryRun, "Only log what would be deleted")
+		case flagsOut:
+			flags.StringVar(&options.out, "out", options.out, "Write the result as JSON to this file")
+		default:
+			panic(fmt.Sprintf("Unknown flag group \"%s\"", group))
+		}
+	}
+}
+
+/// A subcommand, with its own flags
+type command struct {
+	name  string
+	args  string // Positional arguments, for the usage
+	help  string
+	flags []string // Flag groups
+	// Flag groups that depend on the positional arguments, e.g. the stages
+	argFlags func(positional []string) []string
+	run      func(options *cliOptions, config *Config, positional []string)
+}
+
+var commands = []command{
+	{
+		name:  "check",
+		help:  "Check the connections to the logbook DB, the Jiskefet DB and the Jiskefet API",
+		run:   runCheck,
+		flags: []string{flagsLogbook},
+	},
+	{
+		name:  "audit",
+		help:  "Audit the logbook data, for problems to fix before migrating",
+		run:   runAudit,
+		flags: []string{flagsLogbook, flagsOut},
+	},
+	{
+		name: "migrate",
+		args: "subsystems|users|runs|comments|update|all...",
+		help: "Migrate the stages, always in the order subsystems, users, runs, comments, update.\n" +
+			"Update carries edits to already migrated comments over, it needs -idmap and is not part of all.\n" +
+			"Stage flags are only accepted for the stages that are given, e.g. -rmin for runs.",
+		flags:    []string{flagsLogbook, flagsTarget, flagsIDMap},
+		argFlags: migrateStageFlags,
+		run:      runMigrate,
+	},
+	{
+		name:  "verify",
+		help:  "Check that everything in the ID map is in Jiskefet, and list the comments that were not migrated",
+		flags: []string{flagsLogbook, flagsIDMap, flagsOut},
+		run:   runVerify,
+	},
+	{
+		name:  "rollback",
+		args:  "BATCH",
+		help:  "Delete everything the migration batch created, using the ID map it was recorded in",
+		flags: []string{flagsIDMap, flagsRollback, flagsTagCache},
+		run:   runRollback,
+	},
+	{
+		name: "sync",
+		help: "Keep migrating users, runs, comments and attachments that are added to the logbook, until interrupted",
+		flags: []string{flagsLogbook, flagsTarget, flagsIDMap, flagsSubsystemTree, flagsConflicts, flagsUserMerge,
+			flagsRuns, flagsTags, flagsTagCache, flagsFilters, flagsSync},
+		run: runSync,
+	},
+	{
+		name: "config",
+		args: "print",
+		help: "Print the effective configuration, with secrets masked",
+		run:  runConfigPrint,
+	},
+}
+
+/// Returns the stages to migrate, in stage order
+func parseStages(positional []string) []string {
+	if len(positional) == 0 {
+		panic(fmt.Sprintf("Give the stages to migrate: %s or %s", strings.Join(stageOrder, ", "), stageAll))
+	}
+	given := make(map[string]bool)
+	for _, stage := range positional {
+		if stage == stageAll {
+			for _, s := range allStages {
+				given[s] = true
+			}
+			continue
+		}
+		if _, known := stageFlags[stage]; !known {
+			panic(fmt.Sprintf("Unknown stage \"%s\", expected %s or %s", stage, strings.Join(stageOrder, ", "), stageAll))
+		}
+		given[stage] = true
+	}
+	stages := make([]string, 0)
+	for _, stage := range stageOrder {
+		if given[stage] {
+			stages = append(stages, stage)
+		}
+	}
+	return stages
+}
+
+func migrateStageFlags(positional []string) []string {
+	groups := make([]string, 0)
+	for _, stage := range parseStages(positional) {
+		groups = append(groups, stageFlags[stage]...)
+	}
+	return groups
+}
+
+/// Leading arguments that are not flags
+func leadingPositional(arguments []string) []string {
+	for i, argument := range arguments {
+		if strings.HasPrefix(argument, "-") {
+			return arguments[:i]
+		}
+	}
+	return arguments
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [global flags] COMMAND [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", cmd.name, cmd.args, strings.Replace(cmd.help, "\n", "\n    \t", -1))
+	}
+	fmt.Fprintf(out, "\nRun \"%s COMMAND -h\" for the flags of a command.\n\nGlobal flags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	options := newCLIOptions()
+	flag.StringVar(&options.configPath, "config", options.configPath,
+		"YAML file with connection settings and option defaults per profile, see the README")
+	flag.StringVar(&options.profile, "profile", options.profile, "Profile of the config file to use")
+	flag.Var(&options.configSets, "set", "Override a config setting, e.g. -set logbookDB.hostPort=127.0.0.1:3306, repeatable")
+	flag.BoolVar(&options.tlsSkipVerify, "tlsskipverify", options.tlsSkipVerify, "Skip insecure TLS verification")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		// Positional arguments come first, stage flags depend on them
+		arguments := flag.Args()[1:]
+		positional := leadingPositional(arguments)
+		flags := flag.NewFlagSet(name, flag.ExitOnError)
+		flags.Usage = func() {
+			fmt.Fprintf(flags.Output(), "Usage: %s [global flags] %s %s [flags]\n%s\n\nFlags:\n",
+				os.Args[0], cmd.name, cmd.args, cmd.help)
+			flags.PrintDefaults()
+		}
+		groups := cmd.flags
+		if cmd.argFlags != nil && len(positional) > 0 {
+			groups = append(append([]string{}, groups...), cmd.argFlags(positional)...)
+		}
+		options.addFlags(flags, groups...)
+		flags.Parse(arguments[len(positional):])
+		positional = append(positional, flags.Args()...)
+
+		config := loadConfig(options.configPath, options.profile, options.configSets)
+		if cmd.name != "config" {
+			config.applyOptions(flags)
+		}
+		options.commandLine = strings.Join(append(append([]string{name}, positional...), setFlags(flags)), " ")
+		cmd.run(options, config, positional)
+		return
+	}
+	usage()
+	panic(fmt.Sprintf("Unknown command \"%s\"", name))
+}
+
+/// Arguments shared by all commands, from the options and the configuration
+func newArgs(options *cliOptions, config *Config) Args {
+	var args Args
+	args.parallel = options.parallel
+	checkSubsystemTagsMode(options.subsystemTags)
+	args.subsystemTags = options.subsystemTags
+	checkObsoleteSubsystemsMode(options.obsoleteSubsystems)
+	args.obsoleteSubsystems = options.obsoleteSubsystems
+	checkOrphansMode(options.orphans)
+	args.orphans = options.orphans
+	checkConflictMode(options.onConflict)
+	args.onConflict = options.onConflict
+	args.filter = newCommentFilter(options.filter)
+	args.tagRules = loadTagRules(options.tagRulesFile)
+	if options.subsystemRemapFile != "" {
+		args.subsystemRemap = loadSubsystemRemap(options.subsystemRemapFile)
+	}
+	args.tagCacheFile = options.tagCacheFile
+	args.strictTags = options.strictTags
+	args.targetFile = options.targetFile
+	args.report = newReport()
+	config.apply(&args)
+	args.runtime = httptransport.New(args.jiskefetHost, config.values.Jiskefet.Path, nil)
+	args.runtime.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: options.tlsSkipVerify}}
+	args.bearerToken = httptransport.BearerToken(config.values.Jiskefet.APIToken)
+	return args
+}
+
+func runCheck(options *cliOptions, config *Config, positional []string) {
+	noPositional("check", positional)
+	args := newArgs(options, config)
+	log.Printf("Checking connections\n")
+	diagnoseConnections(args, config, options.allowUnknownEnums)
+}
+
+func runAudit(options *cliOptions, config *Config, positional []string) {
+	noPositional("audit", positional)
+	if options.out == "" {
+		panic("Audit needs a file to write the report to, use -out")
+	}
+	config.validate(configNeeds{logbookDB: true, filesDir: true})
+	args := newArgs(options, config)
+	conns := newConnections(args, options.allowUnknownEnums)
+	defer conns.close()
+	log.Printf("Auditing logbook...\n")
+	auditLogbook(args, conns.logbook()).write(options.out)
+}
+
+func runVerify(options *cliOptions, config *Config, positional []string) {
+	noPositional("verify", positional)
+	if options.idMapFile == "" {
+		panic("Verify needs the ID map of the migration, use -idmap")
+	}
+	config.validate(configNeeds{logbookDB: true, jiskefetDB: true})
+	args := newArgs(options, config)
+	conns := newConnections(args, options.allowUnknownEnums)
+	defer conns.close()
+	args.idMap = loadIDMap(options.idMapFile, args.jiskefetHost, "")
+	log.Printf("Verifying...\n")
+	verifyMigration(args, conns.logbook(), conns.jiskefet()).write(options.out)
+}
+
+func runRollback(options *cliOptions, config *Config, positional []string) {
+	if len(positional) != 1 {
+		panic("Give the ID of the batch to roll back")
+	}
+	if options.idMapFile == "" {
+		panic("Rollback needs the ID map the batch was recorded in, use -idmap")
+	}
+	config.validate(configNeeds{jiskefetDB: true})
+	args := newArgs(options, config)
+	conns := newConnections(args, options.allowUnknownEnums)
+	defer conns.close()
+	args.idMap = loadIDMap(options.idMapFile, args.jiskefetHost, "")
+	log.Printf("Rolling back batch \"%s\"...\n", positional[0])
+	rollbackBatch(args, conns.jiskefet(), options.idMapFile, options.tagCacheFile, positional[0], options.rollbackCreated, options.dryRun)
+}
+
+func runConfigPrint(options *cliOptions, config *Config, positional []string) {
+	if len(positional) != 1 || positional[0] != "print" {
+		panic("Unknown config command, expected \"config print\"")
+	}
+	config.print()
+}
+
+func runMigrate(options *cliOptions, config *Config, positional []string) {
+	migrate(options, config, parseStages(positional), false)
+}
+
+func runSync(options *cliOptions, config *Config, positional []string) {
+	noPositional("sync", positional)
+	if options.idMapFile == "" {
+		panic("Sync needs an ID map, use -idmap")
+	}
+	migrate(options, config, nil, true)
+}
+
+func noPositional(name string, positional []string) {
+	if len(positional) > 0 {
+		panic(fmt.Sprintf("Unexpected arguments for %s: %s", name, strings.Join(positional, " ")))
+	}
+}
+
+/// Warns about stages, or sync, that run before the stages they depend on. With an ID
+/// map it knows which stages finished in earlier runs.
+func checkStageDependencies(args Args, stages []string) {
+	running := make(map[string]bool)
+	for _, stage := range stages {
+		running[stage] = true
+	}
+	for _, stage := range stages {
+		for _, dependency := range stageDependencies[stage] {
+			if running[dependency] {
+				continue
+			}
+			if args.idMap == nil {
+				log.Printf("WARNING: Running %s without %s, make sure %s were migrated before (use -idmap to check)\n",
+					stage, dependency, dependency)
+			} else if !args.idMap.stageFinished(dependency) {
+				log.Printf("WARNING: Running %s before %s, the ID map has no finished %s stage\n",
+					stage, dependency, dependency)
+			}
+		}
+	}
+}
+
+/// Migrates the stages, and keeps syncing afterwards with sync
+func migrate(options *cliOptions, config *Config, stages []string, sync bool) {
+	running := make(map[string]bool)
+	for _, stage := range stages {
+		running[stage] = true
+	}
+	if running[stageUpdate] && options.idMapFile == "" {
+		panic("Update needs the ID map of the migration, use -idmap")
+	}
+	// Only what the target and the stages use
+	config.validate(configNeeds{
+		api:        targetNeedsAPI(options.target),
+		logbookDB:  true,
+		jiskefetDB: targetNeedsJiskefetDB(options.target),
+		filesDir:   running[stageComments] || sync,
+	})
+	args := newArgs(options, config)
+	conns := newConnections(args, options.allowUnknownEnums)
+	defer conns.close()
+
+	var jiskefetDB *sql.DB
+	if targetNeedsJiskefetDB(options.target) {
+		jiskefetDB = conns.jiskefet()
+	}
+	log.Printf("Opening %s target\n", options.target)
+	target := openTarget(args, options.target, jiskefetDB)
+	defer func() { check(target.Close()) }()
+
+	args.batchID = newBatchID(options.batchID)
+	batch := newBatchInfo(args, options.commandLine)
+	startBatch(target, batch)
+	defer func() {
+		if r := recover(); r != nil {
+			// What was created before the failure has to be in the map, so it
+			// can be rolled back and isn't created again by the next run
+			if args.idMap != nil {
+				saveIDMapAfterFailure(args, target, options.idMapFile)
+			}
+			args.report.writeAfterFailure(options.reportFile)
+			finishBatch(target, batch, args.report, "failed")
+			panic(r)
+		}
+		finishBatch(target, batch, args.report, "finished")
+	}()
+
+	if options.idMapFile != "" {
+		args.idMap = loadIDMap(options.idMapFile, args.jiskefetHost, options.target)
+		args.idMap.startBatch(args.batchID)
+	}
+	if sync {
+		checkStageDependencies(args, []string{"sync"})
+	} else {
+		checkStageDependencies(args, stages)
+	}
+
+	if (running[stageUsers] || running[stageComments] || sync) && (options.userMergeFile != "" || options.userMergeAuto) {
+		log.Printf("Consolidating users...\n")
+		args.userMerges = buildUserMerges(conns.logbook().Users(), options.userMergeFile, options.userMergeAuto)
+	}
+
+	if options.anonymise {
+		log.Printf("Anonymisation enabled\n")
+		args.anonymiser = newAnonymiser(config.values.AnonymiseKey, conns.logbook().Users(), options.anonymiseAttachments)
+	}
+
+	for _, stage := range stages {
+		// From before the stage, so what is added during it is synced later
+		var latest logbook.Timestamps
+		if args.idMap != nil {
+			latest = conns.logbook().LatestTimestamps()
+		}
+		switch stage {
+		case stageSubsystems:
+			log.Printf("Migrating subsystems...\n")
+			migrateLogbookSubsystems(args, conns.logbook(), target)
+			if options.exportSubscriptions != "" {
+				log.Printf("Exporting subsystem notification settings...\n")
+				exportLogbookSubscriptions(args, conns.logbook(), options.exportSubscriptions)
+			}
+		case stageUsers:
+			log.Printf("Migrating users...\n")
+			migrateLogbookUsers(args, conns.logbook(), target)
+		case stageRuns:
+			log.Printf("Migrating runs...\n")
+			migrateLogbookRuns(args, conns.logbook(), target, options.runMin, options.runMax, options.runLimit)
+		case stageComments:
+			log.Printf("Migrating comments...\n")
+			migrateLogbookComments(args, conns.logbook(), target)
+		case stageUpdate:
+			log.Printf("Updating edited comments...\n")
+			updateLogbookComments(args, conns.logbook(), target, newSubsystemTree(args, logbook.SubsystemsMap(conns.logbook())))
+		}
+		if args.idMap != nil {
+			args.idMap.finishStage(stage)
+			args.idMap.advanceWatermarks(stage, latest)
+			saveIDMap(args, target, options.idMapFile)
+		}
+	}
+
+	// Before the batch is finished, so a failure is recorded with it
+	flushTarget(target)
+
+	if sync {
+		log.Printf("Syncing every %s...\n", options.syncInterval)
+		syncLogbook(args, conns.logbook(), target, options.idMapFile, syncSettings{
+			interval:   options.syncInterval,
+			update:     options.update,
+			runMin:     options.runMin,
+			runMax:     options.runMax,
+			runLimit:   parseRunLimit(options.runLimit),
+			pendingFor: options.syncPendingFor,
+		})
+	}
+
+	args.report.write(options.reportFile)
+}
+
+/// Returns the names of the flags of all commands and stages, sorted
+func allFlagNames() []string {
+	options := newCLIOptions()
+	flags := flag.NewFlagSet("all", flag.ContinueOnError)
+	groups := make([]string, 0)
+	for _, cmd := range commands {
+		groups = append(groups, cmd.flags...)
+	}
+	for _, stage := range stageOrder {
+		groups = append(groups, stageFlags[stage]...)
+	}
+	options.addFlags(flags, groups...)
+	names := make([]string, 0)
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/// Connection settings and secrets, from a YAML file with named profiles, e.g.
+/// one per logbook instance. Example file:
+///   default: its
+///   profiles:
+///     its:
+///       jiskefet: {host: jiskefet.example.com, path: api, apiTokenFile: /run/secrets/jiskefet-token}
+///       logbookDB: {dbName: LOGBOOK_ITSRUN3, hostPort: "127.0.0.1:3306", username: user, passwordFile: /run/secrets/logbook-db}
+///       jiskefetDB: {dbName: jiskefetdb, hostPort: "192.168.122.235:3306", username: user, passwordFile: /run/secrets/jiskefet-db}
+///       filesDir: /home/user/logbook/fileAttachments
+///       options: {parallel: "true", report: its-report.json}
+/// Environment variables override the file, and -set overrides both.
+type configFile struct {
+	Default  string                   `yaml:"default"` // Profile used without -profile
+	Profiles map[string]configProfile `yaml:"profiles"`
+}
+
+type configProfile struct {
+	Jiskefet struct {
+		Host         string `yaml:"host"`
+		Path         string `yaml:"path"`
+		APIToken     string `yaml:"apiToken"`
+		APITokenFile string `yaml:"apiTokenFile"`
+	} `yaml:"jiskefet"`
+	LogbookDB        configDB          `yaml:"logbookDB"`
+	JiskefetDB       configDB          `yaml:"jiskefetDB"`
+	FilesDir         string            `yaml:"filesDir"` // Logbook attachments
+	AnonymiseKey     string            `yaml:"anonymiseKey"`
+	AnonymiseKeyFile string            `yaml:"anonymiseKeyFile"`
+	Options          map[string]string `yaml:"options"` // Defaults for command line flags, by flag name
+}
+
+type configDB struct {
+	DBName       string `yaml:"dbName"`
+	HostPort     string `yaml:"hostPort"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+/// One setting, with where it can come from
+type configField struct {
+	key   string  // As in the file, e.g. "logbookDB.hostPort"
+	env   string  // Environment variable that overrides it
+	value *string // Into the profile
+	file  *string // Secrets only: file to read the value from, also overridden by env + "_FILE"
+}
+
+/// The effective configuration
+type Config struct {
+	path    string
+	profile string
+	values  configProfile
+	sources map[string]string // Key -> where its value came from
+}
+
+func (values *configProfile) fields() []configField {
+	return []configField{
+		{"jiskefet.host", "JISKEFET_HOST", &values.Jiskefet.Host, nil},
+		{"jiskefet.path", "JISKEFET_PATH", &values.Jiskefet.Path, nil},
+		{"jiskefet.apiToken", "JISKEFET_API_TOKEN", &values.Jiskefet.APIToken, &values.Jiskefet.APITokenFile},
+		{"logbookDB.dbName", "JISKEFET_MIGRATE_LOGBOOKDB_DBNAME", &values.LogbookDB.DBName, nil},
+		{"logbookDB.hostPort", "JISKEFET_MIGRATE_LOGBOOKDB_HOSTPORT", &values.LogbookDB.HostPort, nil},
+		{"logbookDB.username", "JISKEFET_MIGRATE_LOGBOOKDB_USERNAME", &values.LogbookDB.Username, nil},
+		{"logbookDB.password", "JISKEFET_MIGRATE_LOGBOOKDB_PASSWORD", &values.LogbookDB.Password, &values.LogbookDB.PasswordFile},
+		{"jiskefetDB.dbName", "JISKEFET_MIGRATE_JISKEFETDB_DBNAME", &values.JiskefetDB.DBName, nil},
+		{"jiskefetDB.hostPort", "JISKEFET_MIGRATE_JISKEFETDB_HOSTPORT", &values.JiskefetDB.HostPort, nil},
+		{"jiskefetDB.username", "JISKEFET_MIGRATE_JISKEFETDB_USERNAME", &values.JiskefetDB.Username, nil},
+		{"jiskefetDB.password", "JISKEFET_MIGRATE_JISKEFETDB_PASSWORD", &values.JiskefetDB.Password, &values.JiskefetDB.PasswordFile},
+		{"filesDir", "JISKEFET_MIGRATE_LOGBOOKDB_FILESDIR", &values.FilesDir, nil},
+		{"anonymiseKey", "JISKEFET_MIGRATE_ANONYMISE_KEY", &values.AnonymiseKey, &values.AnonymiseKeyFile},
+	}
+}
+
+/// Repeatable key=value flag
+type configOverrides []string
+
+func (overrides *configOverrides) String() string {
+	return strings.Join(*overrides, " ")
+}
+
+func (overrides *configOverrides) Set(value string) error {
+	*overrides = append(*overrides, value)
+	return nil
+}
+
+/// Builds the configuration from the profile in the file at path, if any,
+/// the environment and the key=value overrides. The profile defaults to the
+/// file's default, or its only profile.
+func loadConfig(path string, profileName string, overrides []string) *Config {
+	config := &Config{
+		path:    path,
+		sources: make(map[string]string),
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		check(err)
+		var file configFile
+		// Strict, so a typo in a key isn't silently ignored
+		if err := yaml.UnmarshalStrict(data, &file); err != nil {
+			panic(fmt.Sprintf("Config \"%s\": %s", path, err))
+		}
+		if profileName == "" {
+			profileName = file.Default
+		}
+		if profileName == "" && len(file.Profiles) == 1 {
+			for name := range file.Profiles {
+				profileName = name
+			}
+		}
+		profile, exists := file.Profiles[profileName]
+		if !exists {
+			names := make([]string, 0, len(file.Profiles))
+			for name := range file.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			panic(fmt.Sprintf("No profile \"%s\" in config \"%s\", it has: %s", profileName, path, strings.Join(names, ", ")))
+		}
+		config.profile = profileName
+		config.values = profile
+	} else if profileName != "" {
+		panic("A profile needs a config file, use -config")
+	}
+
+	fields := config.values.fields()
+	for _, field := range fields {
+		if *field.value != "" {
+			config.sources[field.key] = fmt.Sprintf("profile %s", config.profile)
+		}
+		if field.file != nil && *field.file != "" {
+			config.setFromFile(field, *field.file)
+		}
+	}
+	for _, field := range fields {
+		if value := os.Getenv(field.env); value != "" {
+			*field.value = value
+			config.sources[field.key] = fmt.Sprintf("env %s", field.env)
+		}
+		if field.file != nil {
+			if path := os.Getenv(field.env + "_FILE"); path != "" {
+				config.setFromFile(field, path)
+			}
+		}
+	}
+	for _, override := range overrides {
+		config.override(fields, override)
+	}
+	return config
+}
+
+/// Applies a key=value override. Secrets can also be given as keyFile=path.
+func (config *Config) override(fields []configField, override string) {
+	parts := strings.SplitN(override, "=", 2)
+	if len(parts) != 2 {
+		panic(fmt.Sprintf("Invalid -set \"%s\", expected key=value", override))
+	}
+	key, value := parts[0], parts[1]
+	for _, field := range fields {
+		if key == field.key {
+			*field.value = value
+			config.sources[field.key] = "-set"
+			return
+		}
+		if field.file != nil && key == field.key+"File" {
+			config.setFromFile(field, value)
+			return
+		}
+	}
+	keys := make([]string, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, field.key)
+	}
+	panic(fmt.Sprintf("Unknown config key \"%s\", expected one of %s", key, strings.Join(keys, ", ")))
+}
+
+/// Reads a secret from a file, without the trailing newline
+func (config *Config) setFromFile(field configField, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("Reading %s: %s", field.key, err))
+	}
+	*field.value = strings.TrimRight(string(data), "\r\n")
+	*field.file = path
+	config.sources[field.key] = fmt.Sprintf("file %s", path)
+}
+
+/// Sets the profile's options as defaults for the flags of the command that
+/// were not given on the command line. Options for other commands are skipped.
+func (config *Config) applyOptions(flags *flag.FlagSet) {
+	known := make(map[string]bool)
+	for _, name := range allFlagNames() {
+		known[name] = true
+	}
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, name := range sortedOptionNames(config.values.Options) {
+		if !known[name] {
+			panic(fmt.Sprintf("Option \"%s\" of profile %s is not a flag of any command", name, config.profile))
+		}
+		if given[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		if err := flags.Set(name, config.values.Options[name]); err != nil {
+			panic(fmt.Sprintf("Option \"%s\" of profile %s: %s", name, config.profile, err))
+		}
+	}
+}
+
+func sortedOptionNames(options map[string]string) []string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/// What the chosen command uses, so only that is required
+type configNeeds struct {
+	api        bool
+	logbookDB  bool
+	jiskefetDB bool
+	filesDir   bool
+}
+
+/// Checks that everything needed is set and well-formed. Panics listing all
+/// problems at once.
+func (config *Config) validate(needs configNeeds) {
+	problems := config.problems(needs)
+	if len(problems) > 0 {
+		panic(fmt.Sprintf("Invalid configuration:\n  %s", strings.Join(problems, "\n  ")))
+	}
+}
+
+func (config *Config) problems(needs configNeeds) []string {
+	problems := make([]string, 0)
+	for _, key := range config.missing(needs) {
+		problems = append(problems, fmt.Sprintf("%s is not set", key))
+	}
+	values := config.values
+	checkHostPort := func(key string, hostPort string) {
+		if hostPort != "" {
+			if _, _, err := net.SplitHostPort(hostPort); err != nil {
+				problems = append(problems, fmt.Sprintf("%s \"%s\": %s", key, hostPort, err))
+			}
+		}
+	}
+
+	if needs.api {
+		if strings.Contains(values.Jiskefet.Host, "/") {
+			problems = append(problems, fmt.Sprintf("jiskefet.host \"%s\" should be a host name, without scheme or path",
+				values.Jiskefet.Host))
+		}
+		if strings.HasPrefix(strings.ToLower(values.Jiskefet.APIToken), "bearer ") {
+			problems = append(problems, "jiskefet.apiToken should be the token only, without \"Bearer\"")
+		}
+	}
+	if needs.logbookDB {
+		checkHostPort("logbookDB.hostPort", values.LogbookDB.HostPort)
+	}
+	if needs.jiskefetDB {
+		checkHostPort("jiskefetDB.hostPort", values.JiskefetDB.HostPort)
+	}
+	if needs.filesDir && values.FilesDir != "" {
+		if info, err := os.Stat(values.FilesDir); err != nil {
+			problems = append(problems, fmt.Sprintf("filesDir: %s", err))
+		} else if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("filesDir \"%s\" is not a directory", values.FilesDir))
+		}
+	}
+	return problems
+}
+
+/// Returns the keys of the needed settings that are not set
+func (config *Config) missing(needs configNeeds) []string {
+	missing := make([]string, 0)
+	for _, field := range config.values.fields() {
+		if *field.value != "" {
+			continue
+		}
+		section := strings.SplitN(field.key, ".", 2)[0]
+		required := (needs.api && (field.key == "jiskefet.host" || field.key == "jiskefet.apiToken")) ||
+			(needs.logbookDB && section == "logbookDB" && field.key != "logbookDB.password") ||
+			(needs.jiskefetDB && section == "jiskefetDB" && field.key != "jiskefetDB.password") ||
+			(needs.filesDir && field.key == "filesDir")
+		if required {
+			missing = append(missing, field.key)
+		}
+	}
+	return missing
+}
+
+/// Prints the effective configuration with secrets masked, where every value
+/// came from, and what would fail validation for a full migration
+func (config *Config) print() {
+	if config.path != "" {
+		fmt.Printf("# Profile %s from \"%s\"\n", config.profile, config.path)
+	} else {
+		fmt.Printf("# No config file, from the environment only\n")
+	}
+	for _, field := range config.values.fields() {
+		value := *field.value
+		if field.file != nil && value != "" {
+			value = "********"
+		}
+		source := config.sources[field.key]
+		if source == "" {
+			source = "not set"
+		}
+		fmt.Printf("%s: %q # %s\n", field.key, value, source)
+	}
+	for _, name := range sortedOptionNames(config.values.Options) {
+		fmt.Printf("options.%s: %q\n", name, config.values.Options[name])
+	}
+	for _, problem := range config.problems(configNeeds{api: true, logbookDB: true, jiskefetDB: true, filesDir: true}) {
+		log.Printf("WARNING: %s\n", problem)
+	}
+}
+
+/// Fills in the connection settings of the arguments, except the API client
+func (config *Config) apply(args *Args) {
+	values := config.values
+	args.jiskefetHost = values.Jiskefet.Host
+	args.logbookFilesDir = values.FilesDir
+	args.logbookDB = DBArgs{
+		dbName:   values.LogbookDB.DBName,
+		hostPort: values.LogbookDB.HostPort,
+		userName: values.LogbookDB.Username,
+		password: values.LogbookDB.Password,
+	}
+	args.jiskefetDB = DBArgs{
+		dbName:   values.JiskefetDB.DBName,
+		hostPort: values.JiskefetDB.HostPort,
+		userName: values.JiskefetDB.Username,
+		password: values.JiskefetDB.Password,
+	}
+}
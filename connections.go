@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// The database connections of a command, each opened when it is first
+/// needed, so a command only needs the connections it uses
+type connections struct {
+	args              Args
+	allowUnknownEnums bool
+	logbookDB         *sql.DB
+	source            logbook.Source
+	jiskefetDB        *sql.DB
+}
+
+func newConnections(args Args, allowUnknownEnums bool) *connections {
+	return &connections{args: args, allowUnknownEnums: allowUnknownEnums}
+}
+
+/// Returns the logbook, opening its DB and checking that the migrator can
+/// read its schema the first time
+func (conns *connections) logbook() logbook.Source {
+	if conns.source == nil {
+		log.Printf("Opening Logbook database\n")
+		conns.logbookDB = openDB(conns.args.logbookDB)
+		conns.source = logbook.NewSQLSource(conns.logbookDB)
+		checkLogbookSchema(logbook.InspectSchema(conns.logbookDB), conns.allowUnknownEnums)
+	}
+	return conns.source
+}
+
+func (conns *connections) jiskefet() *sql.DB {
+	if conns.jiskefetDB == nil {
+		log.Printf("Opening Jiskefet database\n")
+		conns.jiskefetDB = openDB(conns.args.jiskefetDB)
+	}
+	return conns.jiskefetDB
+}
+
+/// Closes the connections that were opened
+func (conns *connections) close() {
+	if conns.logbookDB != nil {
+		conns.logbookDB.Close()
+	}
+	if conns.jiskefetDB != nil {
+		conns.jiskefetDB.Close()
+	}
+}
+
+/// Whether the target writes to the Jiskefet DB
+func targetNeedsJiskefetDB(kind string) bool {
+	return kind == targetJiskefet || kind == targetDB
+}
+
+func targetNeedsAPI(kind string) bool {
+	return kind == targetJiskefet || kind == targetAPI
+}
+
+/// Tables the migration writes to in the Jiskefet DB
+var jiskefetTables = []string{"attachment", "log", "run", "sub_system", "tags", "tags_logs", "user"}
+
+/// Checks everything the migrator connects to, each on its own so one that is
+/// down doesn't hide the others: the Jiskefet API, both DBs and the attachment
+/// directory. Ones that are not configured are skipped. Panics at the end if
+/// any configured one failed.
+func diagnoseConnections(args Args, config *Config, allowUnknownEnums bool) {
+	failed := make([]string, 0)
+	diagnose := func(name string, needs configNeeds, fn func() string) {
+		if missing := config.missing(needs); len(missing) > 0 {
+			log.Printf("%s: SKIPPED, not configured: %s\n", name, strings.Join(missing, ", "))
+			return
+		}
+		if problems := config.problems(needs); len(problems) > 0 {
+			log.Printf("%s: FAILED, invalid configuration: %s\n", name, strings.Join(problems, ", "))
+			failed = append(failed, name)
+			return
+		}
+		started := time.Now()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("%s: FAILED after %s: %v\n", name, time.Since(started).Round(time.Millisecond), r)
+				failed = append(failed, name)
+			}
+		}()
+		result := fn()
+		log.Printf("%s: OK in %s, %s\n", name, time.Since(started).Round(time.Millisecond), result)
+	}
+
+	diagnose("Jiskefet API", configNeeds{api: true}, func() string {
+		checkJiskefetConnection(args)
+		return fmt.Sprintf("GET /logs on %s", args.jiskefetHost)
+	})
+
+	diagnose("Logbook DB", configNeeds{logbookDB: true}, func() string {
+		db := openDB(args.logbookDB)
+		defer db.Close()
+		schema := logbook.InspectSchema(db)
+		checkLogbookSchema(schema, allowUnknownEnums)
+		var comments int
+		check(db.QueryRow("SELECT COUNT(*) FROM logbook_comments").Scan(&comments))
+		return fmt.Sprintf("schema variant %s, %d comments", schema.Variant, comments)
+	})
+
+	diagnose("Jiskefet DB", configNeeds{jiskefetDB: true}, func() string {
+		db := openDB(args.jiskefetDB)
+		defer db.Close()
+		missing := make([]string, 0)
+		for _, table := range jiskefetTables {
+			if !jiskefetTableExists(db, table) {
+				missing = append(missing, table)
+			}
+		}
+		if len(missing) > 0 {
+			panic(fmt.Sprintf("missing tables %s, is this a Jiskefet DB?", strings.Join(missing, ", ")))
+		}
+		notes := []string{"all tables present"}
+		if !jiskefetColumnExists(db, "sub_system", "subsystem_description") {
+			notes = append(notes, "no subsystem descriptions")
+		}
+		if !jiskefetTableExists(db, "migration_batch") {
+			notes = append(notes, "no migration batches recorded yet")
+		}
+		return strings.Join(notes, ", ")
+	})
+
+	diagnose("Attachment directory", configNeeds{filesDir: true}, func() string {
+		entries, err := ioutil.ReadDir(args.logbookFilesDir)
+		check(err)
+		months := 0
+		for _, entry := range entries {
+			// Attachments are in [year]-[month] directories
+			if _, err := time.Parse("2006-01", entry.Name()); err == nil && entry.IsDir() {
+				months++
+			}
+		}
+		if months == 0 {
+			log.Printf("WARNING: No [year]-[month] directories in \"%s\"\n", args.logbookFilesDir)
+		}
+		return fmt.Sprintf("%d month directories in \"%s\"", months, args.logbookFilesDir)
+	})
+
+	if len(failed) > 0 {
+		panic(fmt.Sprintf("Connectivity check failed: %s", strings.Join(failed, ", ")))
+	}
+}
+
+func jiskefetTableExists(jiskefetDB *sql.DB, table string) bool {
+	var count int
+	err := jiskefetDB.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table).Scan(&count)
+	check(err)
+	return count > 0
+}
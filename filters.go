@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// Selects the comment threads to migrate. Criteria that are not set don't
+/// filter, the ones that are set must all match. A thread is selected if its
+/// root matches, or with anyMember if any comment in it matches.
+type commentFilter struct {
+	timeFrom     string // Logbook timestamp, inclusive
+	timeTo       string // Logbook timestamp, inclusive
+	runMin       int64  // 0 for no lower bound
+	runMax       int64  // 0 for no upper bound
+	userIDs      map[int64]bool
+	subsystems   map[string]bool // Subsystem names, a comment matches if filed under one of them or below
+	commentTypes map[string]bool
+	classes      map[string]bool
+	contexts     map[string]bool
+	rootIDs      map[int64]bool // Thread roots to migrate
+	anyMember    bool
+}
+
+/// Flag values for the comment filter, as given on the command line
+type commentFilterFlags struct {
+	from, to       string
+	runMin, runMax int64
+	users          string
+	subsystems     string
+	types          string
+	classes        string
+	contexts       string
+	threads        string
+	anyMember      bool
+}
+
+/// Splits a comma separated flag value, ignoring empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func stringSet(value string) map[string]bool {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+func idSet(value string) map[int64]bool {
+	items := splitList(value)
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[int64]bool)
+	for _, item := range items {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid ID \"%s\": %s", item, err))
+		}
+		set[id] = true
+	}
+	return set
+}
+
+/// Turns a date or timestamp flag into a logbook timestamp. A date alone means
+/// the start of the day, or with endOfDay the end of it.
+func filterTimestamp(value string, endOfDay bool) string {
+	if value == "" {
+		return ""
+	}
+	if _, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			return value + " 23:59:59"
+		}
+		return value + " 00:00:00"
+	}
+	if _, err := time.Parse(logbook.TimestampFormat, value); err != nil {
+		panic(fmt.Sprintf("Invalid time \"%s\", expected YYYY-MM-DD or \"YYYY-MM-DD hh:mm:ss\"", value))
+	}
+	return value
+}
+
+/// Builds the filter, or returns nil if no criteria are set
+func newCommentFilter(flags commentFilterFlags) *commentFilter {
+	filter := &commentFilter{
+		timeFrom:     filterTimestamp(flags.from, false),
+		timeTo:       filterTimestamp(flags.to, true),
+		runMin:       flags.runMin,
+		runMax:       flags.runMax,
+		userIDs:      idSet(flags.users),
+		subsystems:   stringSet(flags.subsystems),
+		commentTypes: stringSet(flags.types),
+		classes:      stringSet(flags.classes),
+		contexts:     stringSet(flags.contexts),
+		rootIDs:      idSet(flags.threads),
+		anyMember:    flags.anyMember,
+	}
+	if filter.timeFrom == "" && filter.timeTo == "" && filter.runMin == 0 && filter.runMax == 0 &&
+		filter.userIDs == nil && filter.subsystems == nil && filter.commentTypes == nil &&
+		filter.classes == nil && filter.contexts == nil && filter.rootIDs == nil {
+		return nil
+	}
+	return filter
+}
+
+/// Checks the comment against all criteria except the thread roots
+func (filter *commentFilter) matches(comment logbook.Comment, subsystemIDs []int64, subsystems *subsystemTree) bool {
+	if filter.timeFrom != "" && comment.TimeCreated.String < filter.timeFrom {
+		return false
+	}
+	if filter.timeTo != "" && comment.TimeCreated.String > filter.timeTo {
+		return false
+	}
+	if filter.runMin != 0 && (!comment.Run.Valid || comment.Run.Int64 < filter.runMin) {
+		return false
+	}
+	if filter.runMax != 0 && (!comment.Run.Valid || comment.Run.Int64 > filter.runMax) {
+		return false
+	}
+	if filter.userIDs != nil && !filter.userIDs[comment.UserID.Int64] {
+		return false
+	}
+	if filter.commentTypes != nil && !filter.commentTypes[comment.CommentType.String] {
+		return false
+	}
+	if filter.classes != nil && !filter.classes[comment.Class.String] {
+		return false
+	}
+	if filter.contexts != nil && !filter.contexts[comment.Context.String] {
+		return false
+	}
+	if filter.subsystems != nil {
+		found := false
+		for _, subsystemID := range subsystemIDs {
+			for _, name := range subsystems.pathNames(subsystemID) {
+				found = found || filter.subsystems[name]
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/// Checks a new thread root, for sync. Its replies are not written yet, so
+/// with anyMember only the root counts.
+func (filter *commentFilter) matchesRoot(source logbook.Source, comment logbook.Comment, subsystems *subsystemTree) bool {
+	if filter.rootIDs != nil && !filter.rootIDs[comment.ID.Int64] {
+		return false
+	}
+	var subsystemIDs []int64
+	if filter.subsystems != nil {
+		subsystemIDs = source.CommentSubsystems(comment.ID.Int64)
+	}
+	return filter.matches(comment, subsystemIDs, subsystems)
+}
+
+/// Returns the roots of the threads the filter selects, in forest order
+func (filter *commentFilter) selectThreads(source logbook.Source, forest *threadForest, subsystems *subsystemTree) []int64 {
+	comments := make(map[int64]logbook.Comment)
+	for _, comment := range source.Comments() {
+		comments[comment.ID.Int64] = comment
+	}
+	commentSubsystems := make(map[int64][]int64) // Comment ID -> subsystem IDs
+	if filter.subsystems != nil {
+		for _, link := range source.SubsystemLinks() {
+			commentSubsystems[link.CommentID.Int64] = append(commentSubsystems[link.CommentID.Int64], link.SubsystemID.Int64)
+		}
+	}
+
+	selected := make([]int64, 0)
+	for _, rootID := range forest.roots {
+		if filter.rootIDs != nil && !filter.rootIDs[rootID] {
+			continue
+		}
+		members := []int64{rootID}
+		if filter.anyMember {
+			members = forest.members(rootID)
+		}
+		for _, id := range members {
+			if filter.matches(comments[id], commentSubsystems[id], subsystems) {
+				selected = append(selected, rootID)
+				break
+			}
+		}
+	}
+	log.Printf("Filters selected %d of %d threads\n", len(selected), len(forest.roots))
+	return selected
+}
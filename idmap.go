@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// What has been migrated so far, with the Jiskefet IDs it got, so later runs
+/// can add to it instead of starting over. Safe for use by parallel workers.
+type idMap struct {
+	mutex      sync.Mutex
+	Host       string                     `json:"host"`   // IDs are only valid for this Jiskefet instance
+	Target     string                     `json:"target"` // and this kind of target
+	Watermarks syncWatermarks             `json:"watermarks"`
+	Logs       map[int64]int64            `json:"logs"`     // Logbook comment ID -> Jiskefet log ID
+	Roots      map[int64]int64            `json:"roots"`    // Logbook comment ID -> Jiskefet log ID of its thread root
+	Files      map[int64]int64            `json:"files"`    // Logbook file ID -> Jiskefet attachment ID, 0 if the target skipped it
+	Runs       map[string]int64           `json:"runs"`     // Logbook run number -> Jiskefet run number
+	Users      map[int64]bool             `json:"users"`    // Logbook user IDs
+	Contents   map[int64]logContents      `json:"contents"` // Logbook comment ID -> what it was migrated as
+	Batches    map[string]*migrationBatch `json:"batches"`  // Batch ID -> what it created
+	Stages     map[string]string          `json:"stages"`   // Migration stage -> when it last finished
+	Pending    map[int64]string           `json:"pending"`  // Logbook comment ID -> when sync first found its parent missing
+	batch      *migrationBatch            // The batch of this run, nil if not recording one
+}
+
+/// What one migration run created in Jiskefet, so it can be rolled back
+type migrationBatch struct {
+	Started     string    `json:"started"`
+	Logs        []int64   `json:"logs"` // In creation order, so replies come after their parents
+	Attachments []int64   `json:"attachments"`
+	TagLinks    []tagLink `json:"tagLinks"`
+	Runs        []int64   `json:"runs"`
+	Tags        []string  `json:"tags"`       // Created by the migration, not the ones that existed already
+	Users       []int64   `json:"users"`      // Inserted by the migration, not the ones that existed already
+	Subsystems  []int64   `json:"subsystems"` // Inserted by the migration, not the ones that existed already
+}
+
+type tagLink struct {
+	LogID int64  `json:"logId"`
+	Tag   string `json:"tag"`
+}
+
+/// Logbook timestamps up to which rows have been synced. Rows at the
+/// watermark itself are looked at again, the ID map tells which are done.
+/// The migration stages set them too, so a sync only looks at what is newer.
+type syncWatermarks struct {
+	Comments string `json:"comments"` // logbook_comments.time_created
+	Files    string `json:"files"`    // logbook_files.time_created
+	Runs     string `json:"runs"`     // logbook.time_update
+}
+
+/// Loads the ID map from path, or starts a new one if it doesn't exist yet.
+/// An empty target accepts a map of any target.
+func loadIDMap(path string, host string, target string) *idMap {
+	ids := &idMap{
+		Host:     host,
+		Target:   target,
+		Logs:     make(map[int64]int64),
+		Roots:    make(map[int64]int64),
+		Files:    make(map[int64]int64),
+		Runs:     make(map[string]int64),
+		Users:    make(map[int64]bool),
+		Contents: make(map[int64]logContents),
+		Batches:  make(map[string]*migrationBatch),
+		Stages:   make(map[string]string),
+		Pending:  make(map[int64]string),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("No ID map at \"%s\" yet\n", path)
+		return ids
+	}
+	check(err)
+	check(json.Unmarshal(data, ids))
+	if ids.Contents == nil {
+		ids.Contents = make(map[int64]logContents) // ID maps from before contents were recorded
+	}
+	if ids.Batches == nil {
+		ids.Batches = make(map[string]*migrationBatch) // ID maps from before batches were recorded
+	}
+	if ids.Stages == nil {
+		ids.Stages = make(map[string]string) // ID maps from before stages were recorded
+	}
+	if ids.Pending == nil {
+		ids.Pending = make(map[int64]string) // ID maps from before pending comments were recorded
+	}
+	if target == "" {
+		target = ids.Target // Any target, for commands that only read the map
+	}
+	if ids.Host != host || ids.Target != target {
+		// Migrating again on top of IDs of another instance would duplicate everything
+		panic(fmt.Sprintf("ID map \"%s\" is for %s target on \"%s\", not %s target on \"%s\"",
+			path, ids.Target, ids.Host, target, host))
+	}
+	log.Printf("Loaded ID map \"%s\": %d logs, %d files, %d runs, %d users\n",
+		path, len(ids.Logs), len(ids.Files), len(ids.Runs), len(ids.Users))
+	return ids
+}
+
+/// Records what this run creates under the given batch ID, adding to the batch
+/// if it exists already
+func (ids *idMap) startBatch(batchID string) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	if batch, exists := ids.Batches[batchID]; exists {
+		log.Printf("Adding to existing batch \"%s\"\n", batchID)
+		ids.batch = batch
+		return
+	}
+	ids.batch = &migrationBatch{
+		Started:     time.Now().UTC().Format(time.RFC3339),
+		Logs:        make([]int64, 0),
+		Attachments: make([]int64, 0),
+		TagLinks:    make([]tagLink, 0),
+		Runs:        make([]int64, 0),
+		Tags:        make([]string, 0),
+		Users:       make([]int64, 0),
+		Subsystems:  make([]int64, 0),
+	}
+	ids.Batches[batchID] = ids.batch
+	log.Printf("Recording batch \"%s\"\n", batchID)
+}
+
+/// Writes the ID map to path. It's written to a temporary file first, so an
+/// interrupted save doesn't lose the previous one.
+func (ids *idMap) save(path string) {
+	ids.mutex.Lock()
+	data, err := json.MarshalIndent(ids, "", "  ")
+	ids.mutex.Unlock()
+	check(err)
+	check(ioutil.WriteFile(path+".tmp", data, 0644))
+	check(os.Rename(path+".tmp", path))
+	log.Printf("Saved ID map \"%s\"\n", path)
+}
+
+func (ids *idMap) addLog(logbookID int64, jiskefetID int64, jiskefetRootID int64) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Logs[logbookID] = jiskefetID
+	ids.Roots[logbookID] = jiskefetRootID
+	if ids.batch != nil {
+		ids.batch.Logs = append(ids.batch.Logs, jiskefetID)
+	}
+}
+
+func (ids *idMap) addTagLink(logID int64, tagText string) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	if ids.batch != nil {
+		ids.batch.TagLinks = append(ids.batch.TagLinks, tagLink{LogID: logID, Tag: tagText})
+	}
+}
+
+func (ids *idMap) addCreatedTags(tagTexts []string) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	if ids.batch != nil {
+		ids.batch.Tags = append(ids.batch.Tags, tagTexts...)
+	}
+}
+
+func (ids *idMap) addSubsystem(subsystemID int64, inserted bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	if ids.batch != nil && inserted {
+		ids.batch.Subsystems = append(ids.batch.Subsystems, subsystemID)
+	}
+}
+
+/// Returns the Jiskefet log and thread root IDs of a logbook comment
+func (ids *idMap) logIDs(logbookID int64) (int64, int64, bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	jiskefetID, exists := ids.Logs[logbookID]
+	return jiskefetID, ids.Roots[logbookID], exists
+}
+
+func (ids *idMap) addFile(fileID int64, attachmentID int64) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Files[fileID] = attachmentID
+	if ids.batch != nil && attachmentID != 0 {
+		ids.batch.Attachments = append(ids.batch.Attachments, attachmentID)
+	}
+}
+
+func (ids *idMap) hasFile(fileID int64) bool {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	_, exists := ids.Files[fileID]
+	return exists
+}
+
+func (ids *idMap) addRun(logbookRun string, runNumber int64) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Runs[logbookRun] = runNumber
+	if ids.batch != nil {
+		ids.batch.Runs = append(ids.batch.Runs, runNumber)
+	}
+}
+
+func (ids *idMap) hasRun(logbookRun string) bool {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	_, exists := ids.Runs[logbookRun]
+	return exists
+}
+
+func (ids *idMap) addUser(userID int64, inserted bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Users[userID] = true
+	if ids.batch != nil && inserted {
+		ids.batch.Users = append(ids.batch.Users, userID)
+	}
+}
+
+func (ids *idMap) hasUser(userID int64) bool {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	return ids.Users[userID]
+}
+
+func (ids *idMap) setContents(logbookID int64, contents logContents) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Contents[logbookID] = contents
+}
+
+/// Returns what the comment was migrated as, if that was recorded
+func (ids *idMap) contents(logbookID int64) (logContents, bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	contents, exists := ids.Contents[logbookID]
+	return contents, exists
+}
+
+func (ids *idMap) finishStage(stage string) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	ids.Stages[stage] = time.Now().UTC().Format(time.RFC3339)
+}
+
+/// Moves the watermarks of what the stage migrates up to the logbook's newest
+/// timestamps from before it started. They only move forward.
+func (ids *idMap) advanceWatermarks(stage string, latest logbook.Timestamps) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	advance := func(watermark *string, timestamp string) {
+		if timestamp > *watermark {
+			*watermark = timestamp
+		}
+	}
+	switch stage {
+	case stageRuns:
+		advance(&ids.Watermarks.Runs, latest.RunUpdated)
+	case stageComments:
+		advance(&ids.Watermarks.Comments, latest.CommentCreated)
+		advance(&ids.Watermarks.Files, latest.FileCreated)
+	}
+}
+
+/// Returns whether the stage finished in an earlier run
+func (ids *idMap) stageFinished(stage string) bool {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	_, finished := ids.Stages[stage]
+	return finished
+}
+
+/// Returns the IDs of the migrated comments, in ID order
+func (ids *idMap) logbookIDs() []int64 {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	return sortedKeys(ids.Logs)
+}
+
+/// Removes a rolled back batch, and everything it created, from the ID map,
+/// so it can be migrated again. Users stay unless withCreated, because they
+/// are only deleted then.
+func (ids *idMap) forgetBatch(batchID string, withCreated bool) {
+	ids.mutex.Lock()
+	defer ids.mutex.Unlock()
+	batch := ids.Batches[batchID]
+	logs := make(map[int64]bool)
+	for _, logID := range batch.Logs {
+		logs[logID] = true
+	}
+	for logbookID, logID := range ids.Logs {
+		if logs[logID] {
+			delete(ids.Logs, logbookID)
+			delete(ids.Roots, logbookID)
+			delete(ids.Contents, logbookID)
+		}
+	}
+	attachments := make(map[int64]bool)
+	for _, attachmentID := range batch.Attachments {
+		attachments[attachmentID] = true
+	}
+	for fileID, attachmentID := range ids.Files {
+		if attachments[attachmentID] {
+			delete(ids.Files, fileID)
+		}
+	}
+	runs := make(map[int64]bool)
+	for _, runNumber := range batch.Runs {
+		runs[runNumber] = true
+	}
+	for logbookRun, runNumber := range ids.Runs {
+		if runs[runNumber] {
+			delete(ids.Runs, logbookRun)
+		}
+	}
+	if withCreated {
+		for _, userID := range batch.Users {
+			delete(ids.Users, userID)
+		}
+	}
+	delete(ids.Batches, batchID)
+}
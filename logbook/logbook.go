@@ -2,6 +2,9 @@ package logbook
 
 import "database/sql"
 
+// TimestampFormat is the layout of the logbook's timestamp columns, for time.Parse
+const TimestampFormat = "2006-01-02 15:04:05"
+
 type Run struct {
 	Run                                    sql.NullString
 	Time_created                           sql.NullFloat64
@@ -99,10 +102,24 @@ type Comment struct {
 	Deleted                    sql.NullInt64
 	Parent                     sql.NullInt64
 	RootParent                 sql.NullInt64
-	Dashboard                  sql.NullInt64
-	TimeValidity               sql.NullString // timestamp
-	ProcessedEmailNotification sql.NullInt64
-	Context                    sql.NullString // enum('DEFAULT','QUALITYFLAG','GLOBALQUALITYFLAG','EORREASON')
+	Dashboard                  sql.NullInt64  `logbook:"optional"`
+	TimeValidity               sql.NullString `logbook:"optional"` // timestamp
+	ProcessedEmailNotification sql.NullInt64  `logbook:"optional"`
+	Context                    sql.NullString `logbook:"optional"` // enum('DEFAULT','QUALITYFLAG','GLOBALQUALITYFLAG','EORREASON')
+}
+
+// CommentKind is a combination of type, class and context that comments have
+type CommentKind struct {
+	CommentType sql.NullString
+	Class       sql.NullString
+	Context     sql.NullString `logbook:"optional"`
+}
+
+// CommentLink is the place of a comment in its thread, without its contents
+type CommentLink struct {
+	ID         int64
+	Parent     sql.NullInt64
+	RootParent sql.NullInt64
 }
 
 type File struct {
@@ -119,11 +136,11 @@ type File struct {
 type User struct {
 	ID        sql.NullInt64  // int(11)
 	Username  sql.NullString // char(32)
-	FirstName sql.NullString // char(32)
+	FirstName sql.NullString `logbook:"optional"` // char(32)
 	FullName  sql.NullString // char(128)
 	Email     sql.NullString // char(128)
-	GroupName sql.NullString // char(16)
-	LastLogin sql.NullString // timestamp
+	GroupName sql.NullString `logbook:"optional"` // char(16)
+	LastLogin sql.NullString `logbook:"optional"` // timestamp
 }
 
 type Subsystem struct {
@@ -131,14 +148,14 @@ type Subsystem struct {
 	Name                     sql.NullString // char(32)
 	Text                     sql.NullString // char(64)
 	Parent                   sql.NullInt64  // int(11)
-	Email                    sql.NullString // char(64)
-	EmailProcess             sql.NullString // char(64)
-	NotifyNoRunLogEntries    sql.NullInt64  // tinyint(1)
-	NotifyRunLogEntries      sql.NullInt64  // tinyint(1)
-	NotifyQualityFlags       sql.NullInt64  // tinyint(1)
-	NotifyGlobalQualityFlags sql.NullInt64  // tinyint(1)
-	NotifyProcessLogEntries  sql.NullString // text
-	Obsolete                 sql.NullInt64  // tinyint(1)
+	Email                    sql.NullString `logbook:"optional"` // char(64)
+	EmailProcess             sql.NullString `logbook:"optional"` // char(64)
+	NotifyNoRunLogEntries    sql.NullInt64  `logbook:"optional"` // tinyint(1)
+	NotifyRunLogEntries      sql.NullInt64  `logbook:"optional"` // tinyint(1)
+	NotifyQualityFlags       sql.NullInt64  `logbook:"optional"` // tinyint(1)
+	NotifyGlobalQualityFlags sql.NullInt64  `logbook:"optional"` // tinyint(1)
+	NotifyProcessLogEntries  sql.NullString `logbook:"optional"` // text
+	Obsolete                 sql.NullInt64  `logbook:"optional"` // tinyint(1)
 }
 
 type CommentSubsystems struct {
@@ -2,7 +2,10 @@ package logbook
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"reflect"
+	"strings"
 )
 
 func check(err error) {
@@ -12,176 +15,207 @@ func check(err error) {
 	}
 }
 
-// ScanRun ...
-func ScanRun(rows *sql.Rows) Run {
+// Tables maps the logbook tables to the struct their rows are scanned into
+var Tables = map[string]interface{}{
+	"logbook":                     Run{},
+	"logbook_comments":            Comment{},
+	"logbook_files":               File{},
+	"logbook_users":               User{},
+	"logbook_subsystems":          Subsystem{},
+	"logbook_comments_subsystems": CommentSubsystems{},
+}
+
+// normalizeName makes column and field names comparable, so that for example
+// column "time_created" matches field "TimeCreated", and "daq_time_start"
+// matches "DAQ_time_start"
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// fieldIndex maps the normalized column name of each field of the struct
+// type to the field index
+func fieldIndex(t reflect.Type) map[string]int {
+	index := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		index[normalizeName(t.Field(i).Name)] = i
+	}
+	return index
+}
+
+// isOptional tells if a field may be missing from the table, because not
+// every logbook deployment has its column. Such fields are tagged
+// `logbook:"optional"`, and stay NULL when the column is missing.
+func isOptional(field reflect.StructField) bool {
+	return field.Tag.Get("logbook") == "optional"
+}
+
+// MissingColumns returns the fields of row, a struct like Comment, that have
+// no matching column in columns. Optional fields are only included if
+// withOptional is set.
+func MissingColumns(columns []string, row interface{}, withOptional bool) []string {
+	t := reflect.TypeOf(row)
+	present := make(map[string]bool)
+	for _, column := range columns {
+		present[normalizeName(column)] = true
+	}
+	missing := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		if !present[normalizeName(t.Field(i).Name)] && (withOptional || !isOptional(t.Field(i))) {
+			missing = append(missing, t.Field(i).Name)
+		}
+	}
+	return missing
+}
+
+// ExtraColumns returns the columns that have no matching field in row
+func ExtraColumns(columns []string, row interface{}) []string {
+	index := fieldIndex(reflect.TypeOf(row))
+	extra := make([]string, 0)
+	for _, column := range columns {
+		if _, exists := index[normalizeName(column)]; !exists {
+			extra = append(extra, column)
+		}
+	}
+	return extra
+}
+
+// Scanner scans the rows of one query into structs like Comment, matching
+// columns to fields by name instead of position. The columns are matched once
+// per struct type, on its first row. Columns without a matching field are
+// skipped, required fields without a matching column are an error.
+type Scanner struct {
+	rows    *sql.Rows
+	columns []string
+	fields  map[reflect.Type][]int // Struct type -> field index of each column, -1 for columns without a field
+}
+
+// NewScanner ...
+func NewScanner(rows *sql.Rows) *Scanner {
+	return &Scanner{rows: rows, fields: make(map[reflect.Type][]int)}
+}
+
+// fieldsOf returns the field index of each column for the struct type
+func (scanner *Scanner) fieldsOf(t reflect.Type) ([]int, error) {
+	if fields, exists := scanner.fields[t]; exists {
+		return fields, nil
+	}
+	if scanner.columns == nil {
+		columns, err := scanner.rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		scanner.columns = columns
+	}
+	if missing := MissingColumns(scanner.columns, reflect.Zero(t).Interface(), false); len(missing) > 0 {
+		return nil, fmt.Errorf("no columns for %s fields %s", t.Name(), strings.Join(missing, ", "))
+	}
+
+	index := fieldIndex(t)
+	fields := make([]int, len(scanner.columns))
+	for i, column := range scanner.columns {
+		if field, exists := index[normalizeName(column)]; exists {
+			fields[i] = field
+		} else {
+			fields[i] = -1
+		}
+	}
+	scanner.fields[t] = fields
+	return fields, nil
+}
+
+// scan scans the current row into the struct dest points to
+func (scanner *Scanner) scan(dest interface{}) error {
+	value := reflect.ValueOf(dest).Elem()
+	fields, err := scanner.fieldsOf(value.Type())
+	if err != nil {
+		return err
+	}
+	targets := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if field >= 0 {
+			targets[i] = value.Field(field).Addr().Interface()
+		} else {
+			targets[i] = new(sql.RawBytes) // Unknown column, ignored
+		}
+	}
+	return scanner.rows.Scan(targets...)
+}
+
+// Run ...
+func (scanner *Scanner) Run() Run {
 	var row Run
-	err := rows.Scan(
-		&row.Run,
-		&row.Time_created,
-		&row.DAQ_time_start,
-		&row.DAQ_time_end,
-		&row.TRGTimeStart,
-		&row.TRGTimeEnd,
-		&row.Time_update,
-		&row.RunDuration,
-		&row.PauseDuration,
-		&row.Partition,
-		&row.Detector,
-		&row.Run_type,
-		&row.Calibration,
-		&row.BeamEnergy,
-		&row.BeamType,
-		&row.LHCBeamMode,
-		&row.LHCFillNumber,
-		&row.LHCTotalInteractingBunches,
-		&row.LHCTotalNonInteractingBunchesBeam1,
-		&row.LHCTotalNonInteractingBunchesBeam2,
-		&row.LHCBetaStar,
-		&row.LHCFillingSchemeName,
-		&row.LHCInstIntensityNonInteractingBeam1SOR,
-		&row.LHCInstIntensityNonInteractingBeam1EOR,
-		&row.LHCInstIntensityNonInteractingBeam1Avg,
-		&row.LHCInstIntensityInteractingBeam1SOR,
-		&row.LHCInstIntensityInteractingBeam1EOR,
-		&row.LHCInstIntensityInteractingBeam1Avg,
-		&row.LHCInstIntensityNonInteractingBeam2SOR,
-		&row.LHCInstIntensityNonInteractingBeam2EOR,
-		&row.LHCInstIntensityNonInteractingBeam2Avg,
-		&row.LHCInstIntensityInteractingBeam2SOR,
-		&row.LHCInstIntensityInteractingBeam2EOR,
-		&row.LHCInstIntensityInteractingBeam2Avg,
-		&row.LHCInfoStatus,
-		&row.ForceLHCReco,
-		&row.NumberOfDetectors,
-		&row.DetectorMask,
-		&row.SplitterDetectorMask,
-		&row.Log,
-		&row.TotalSubEvents,
-		&row.TotalDataReadout,
-		&row.TotalEvents,
-		&row.TotalEventsPhysics,
-		&row.TotalEventsCalibration,
-		&row.TotalEventsIncomplete,
-		&row.TotalDataEventBuilder,
-		&row.TotalDataRecorded,
-		&row.AverageDataRateReadout,
-		&row.AverageDataRateEventBuilder,
-		&row.AverageDataRateRecorded,
-		&row.AverageSubEventsPerSecond,
-		&row.AverageEventsPerSecond,
-		&row.NumberOfLDCs,
-		&row.NumberOfGDCs,
-		&row.NumberOfStreams,
-		&row.LHCperiod,
-		&row.HLTmode,
-		&row.LDClocalRecording,
-		&row.GDClocalRecording,
-		&row.GDCmStreamRecording,
-		&row.EventBuilding,
-		&row.Time_completed,
-		&row.Ecs_success,
-		&row.Daq_success,
-		&row.Eor_reason,
-		&row.DataMigrated,
-		&row.RunQuality,
-		&row.L3_magnetCurrent,
-		&row.Dipole_magnetCurrent,
-		&row.L2a,
-		&row.CtpDuration,
-		&row.Ecs_iteration_current,
-		&row.Ecs_iteration_total,
-		&row.TotalNumberOfFilesWriting,
-		&row.TotalNumberOfFilesClosed,
-		&row.TotalNumberOfFilesWaitingMigration,
-		&row.TotalNumberOfFilesMigrationRequested,
-		&row.TotalNumberOfFilesMigrating,
-		&row.TotalNumberOfFilesMigrated,
-		&row.NumberOfPar,
-		&row.NumberOfFailedPar)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
 
-/// ScanComment ...
-func ScanComment(rows *sql.Rows) Comment {
+// Comment ...
+func (scanner *Scanner) Comment() Comment {
 	var row Comment
-	err := rows.Scan(
-		&row.ID,
-		&row.Run,
-		&row.UserID,
-		&row.Title,
-		&row.Comment,
-		&row.Class,
-		&row.CommentType,
-		&row.TimeCreated,
-		&row.Deleted,
-		&row.Parent,
-		&row.RootParent,
-		&row.Dashboard,
-		&row.TimeValidity,
-		&row.ProcessedEmailNotification,
-		&row.Context)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
 
-/// ScanUser ...
-func ScanUser(rows *sql.Rows) User {
+// CommentKind ...
+func (scanner *Scanner) CommentKind() CommentKind {
+	var row CommentKind
+	check(scanner.scan(&row))
+	return row
+}
+
+// User ...
+func (scanner *Scanner) User() User {
 	var row User
-	err := rows.Scan(
-		&row.ID,
-		&row.Username,
-		&row.FirstName,
-		&row.FullName,
-		&row.Email,
-		&row.GroupName,
-		&row.LastLogin)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
 
-/// ScanFile ...
-func ScanFile(rows *sql.Rows) File {
+// File ...
+func (scanner *Scanner) File() File {
 	var row File
-	err := rows.Scan(
-		&row.CommentID,
-		&row.FileID,
-		&row.FileName,
-		&row.Size,
-		&row.Title,
-		&row.ContentType,
-		&row.TimeCreated,
-		&row.Deleted)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
 
-/// ScanSubsystem ...
-func ScanSubsystem(rows *sql.Rows) Subsystem {
+// Subsystem ...
+func (scanner *Scanner) Subsystem() Subsystem {
 	var row Subsystem
-	err := rows.Scan(
-		&row.ID,
-		&row.Name,
-		&row.Text,
-		&row.Parent,
-		&row.Email,
-		&row.EmailProcess,
-		&row.NotifyNoRunLogEntries,
-		&row.NotifyRunLogEntries,
-		&row.NotifyQualityFlags,
-		&row.NotifyGlobalQualityFlags,
-		&row.NotifyProcessLogEntries,
-		&row.Obsolete)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
 
-/// ScanCommentSubsystems ...
-func ScanCommentSubsystems(rows *sql.Rows) CommentSubsystems {
+// CommentSubsystems ...
+func (scanner *Scanner) CommentSubsystems() CommentSubsystems {
 	var row CommentSubsystems
-	err := rows.Scan(
-		&row.CommentID,
-		&row.SubsystemID)
-	check(err)
+	check(scanner.scan(&row))
 	return row
 }
+
+// ScanRun scans a single row, use a Scanner for more
+func ScanRun(rows *sql.Rows) Run {
+	return NewScanner(rows).Run()
+}
+
+/// ScanComment ...
+func ScanComment(rows *sql.Rows) Comment {
+	return NewScanner(rows).Comment()
+}
+
+/// ScanUser ...
+func ScanUser(rows *sql.Rows) User {
+	return NewScanner(rows).User()
+}
+
+/// ScanFile ...
+func ScanFile(rows *sql.Rows) File {
+	return NewScanner(rows).File()
+}
+
+/// ScanSubsystem ...
+func ScanSubsystem(rows *sql.Rows) Subsystem {
+	return NewScanner(rows).Subsystem()
+}
+
+/// ScanCommentSubsystems ...
+func ScanCommentSubsystems(rows *sql.Rows) CommentSubsystems {
+	return NewScanner(rows).CommentSubsystems()
+}
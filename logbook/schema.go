@@ -0,0 +1,195 @@
+package logbook
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema variants, from the columns found in the logbook tables
+const (
+	SchemaFull        = "full"        // Every column the migrator knows
+	SchemaReduced     = "reduced"     // Some optional columns missing, as in older deployments
+	SchemaUnsupported = "unsupported" // Tables or required columns missing
+)
+
+// KnownEnumValues are the values of the enum columns the migrator knows how to
+// migrate, by table and field
+var KnownEnumValues = map[string]map[string][]string{
+	"logbook_comments": {
+		"Class":       {"HUMAN", "PROCESS"},
+		"CommentType": {"GENERAL", "HARDWARE", "CAVERN", "DQM/QA", "SOFTWARE", "NETWORK", "EOS", "DCS", "OTHER"},
+		"Context":     {"DEFAULT", "QUALITYFLAG", "GLOBALQUALITYFLAG", "EORREASON"},
+	},
+}
+
+// Schema describes the logbook schema found in the database
+type Schema struct {
+	Variant           string
+	MissingTables     []string
+	MissingColumns    map[string][]string // Table -> required fields without a column
+	MissingOptional   map[string][]string // Table -> optional fields without a column
+	ExtraColumns      map[string][]string // Table -> columns without a field, ignored
+	UnknownEnumValues map[string][]string // "table.Field" -> enum values the migrator doesn't know
+}
+
+// parseEnum returns the values of a column type like "enum('A','B')", or nil
+// if it's not an enum
+func parseEnum(columnType string) []string {
+	if !strings.HasPrefix(columnType, "enum(") || !strings.HasSuffix(columnType, ")") {
+		return nil
+	}
+	values := make([]string, 0)
+	for _, value := range strings.Split(columnType[len("enum("):len(columnType)-1], ",") {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'")
+		values = append(values, strings.Replace(value, "''", "'", -1))
+	}
+	return values
+}
+
+// unknownValues returns the values that are not in known
+func unknownValues(values []string, known []string) []string {
+	unknown := make([]string, 0)
+	for _, value := range values {
+		found := false
+		for _, k := range known {
+			if value == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, value)
+		}
+	}
+	return unknown
+}
+
+// InspectSchema reads the columns of the logbook tables from
+// information_schema and compares them with what the migrator knows
+func InspectSchema(db *sql.DB) Schema {
+	tableNames := make([]string, 0, len(Tables))
+	for table := range Tables {
+		tableNames = append(tableNames, table)
+	}
+	sort.Strings(tableNames)
+
+	columns := make(map[string][]string)   // Table -> column names
+	columnTypes := make(map[string]string) // "table.normalized column" -> column type
+	rows, err := db.Query("SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN (?"+strings.Repeat(",?", len(tableNames)-1)+") "+
+		"ORDER BY TABLE_NAME, ORDINAL_POSITION", stringsToArgs(tableNames)...)
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var table, column, columnType string
+		check(rows.Scan(&table, &column, &columnType))
+		columns[table] = append(columns[table], column)
+		columnTypes[table+"."+normalizeName(column)] = columnType
+	}
+	check(rows.Err())
+
+	schema := Schema{
+		MissingTables:     make([]string, 0),
+		MissingColumns:    make(map[string][]string),
+		MissingOptional:   make(map[string][]string),
+		ExtraColumns:      make(map[string][]string),
+		UnknownEnumValues: make(map[string][]string),
+	}
+	for _, table := range tableNames {
+		if _, exists := columns[table]; !exists {
+			schema.MissingTables = append(schema.MissingTables, table)
+			continue
+		}
+		row := Tables[table]
+		required := MissingColumns(columns[table], row, false)
+		if len(required) > 0 {
+			schema.MissingColumns[table] = required
+		}
+		if all := MissingColumns(columns[table], row, true); len(all) > len(required) {
+			schema.MissingOptional[table] = unknownValues(all, required)
+		}
+		if extra := ExtraColumns(columns[table], row); len(extra) > 0 {
+			schema.ExtraColumns[table] = extra
+		}
+	}
+
+	for table, fields := range KnownEnumValues {
+		for field, known := range fields {
+			columnType, exists := columnTypes[table+"."+normalizeName(field)]
+			if !exists {
+				continue
+			}
+			if unknown := unknownValues(parseEnum(columnType), known); len(unknown) > 0 {
+				schema.UnknownEnumValues[table+"."+field] = unknown
+			}
+		}
+	}
+
+	switch {
+	case len(schema.MissingTables) > 0 || len(schema.MissingColumns) > 0:
+		schema.Variant = SchemaUnsupported
+	case len(schema.MissingOptional) > 0:
+		schema.Variant = SchemaReduced
+	default:
+		schema.Variant = SchemaFull
+	}
+	return schema
+}
+
+func stringsToArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// Problems returns what makes the schema impossible to migrate
+func (schema Schema) Problems() []string {
+	problems := make([]string, 0)
+	for _, table := range schema.MissingTables {
+		problems = append(problems, fmt.Sprintf("table %s is missing", table))
+	}
+	for _, table := range sortedTables(schema.MissingColumns) {
+		problems = append(problems, fmt.Sprintf("table %s has no columns for %s", table,
+			strings.Join(schema.MissingColumns[table], ", ")))
+	}
+	return problems
+}
+
+// Unexpected returns what the migrator can work around, but only by adapting
+// the migration: unknown enum values are migrated as they are, without the
+// tag rules written for the known ones
+func (schema Schema) Unexpected() []string {
+	unexpected := make([]string, 0)
+	for _, column := range sortedTables(schema.UnknownEnumValues) {
+		unexpected = append(unexpected, fmt.Sprintf("%s has unknown values %s", column,
+			strings.Join(schema.UnknownEnumValues[column], ", ")))
+	}
+	return unexpected
+}
+
+// Notes returns the differences that are handled without adapting anything
+func (schema Schema) Notes() []string {
+	notes := make([]string, 0)
+	for _, table := range sortedTables(schema.MissingOptional) {
+		notes = append(notes, fmt.Sprintf("table %s has no columns for %s, these are left empty", table,
+			strings.Join(schema.MissingOptional[table], ", ")))
+	}
+	for _, table := range sortedTables(schema.ExtraColumns) {
+		notes = append(notes, fmt.Sprintf("table %s has unknown columns %s, these are ignored", table,
+			strings.Join(schema.ExtraColumns[table], ", ")))
+	}
+	return notes
+}
+
+func sortedTables(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,53 @@
+package logbook
+
+// Source is where the logbook data to migrate is read from. Errors while
+// reading panic, like the Scan functions.
+type Source interface {
+	// Runs returns the runs with a run number between lower and upper, at most limit of them
+	Runs(lower string, upper string, limit string) []Run
+	// RunsUpdatedSince returns the runs updated at or after the timestamp with a run number
+	// between lower and upper, oldest first
+	RunsUpdatedSince(timestamp string, lower string, upper string) []Run
+	// LatestTimestamps returns the newest timestamps of the runs, comments and files
+	LatestTimestamps() Timestamps
+	// Comments returns all comments
+	Comments() []Comment
+	// CommentsSince returns the comments created at or after the timestamp, oldest first
+	CommentsSince(timestamp string) []Comment
+	// CommentKinds returns the distinct combinations of type, class and context of the comments
+	CommentKinds() []CommentKind
+	// Comment returns the comment with the given ID
+	Comment(id int64) Comment
+	// CommentLinks returns the thread links of all comments, ordered by ID
+	CommentLinks() []CommentLink
+	// CommentFiles returns the attachment metadata of a comment
+	CommentFiles(commentID int64) []File
+	// CommentSubsystems returns the IDs of the subsystems a comment is filed under
+	CommentSubsystems(commentID int64) []int64
+	// Files returns the attachment metadata of all comments
+	Files() []File
+	// FilesSince returns the attachment metadata created at or after the timestamp, oldest first
+	FilesSince(timestamp string) []File
+	// SubsystemLinks returns all links between comments and subsystems
+	SubsystemLinks() []CommentSubsystems
+	// Users returns all users
+	Users() []User
+	// Subsystems returns all subsystems
+	Subsystems() []Subsystem
+}
+
+// Timestamps are the newest logbook timestamps, empty if there are no rows
+type Timestamps struct {
+	RunUpdated     string // logbook.time_update
+	CommentCreated string // logbook_comments.time_created
+	FileCreated    string // logbook_files.time_created
+}
+
+// SubsystemsMap returns the subsystems of the source by ID
+func SubsystemsMap(source Source) map[int64]Subsystem {
+	subsystems := make(map[int64]Subsystem)
+	for _, subsystem := range source.Subsystems() {
+		subsystems[subsystem.ID.Int64] = subsystem
+	}
+	return subsystems
+}
@@ -0,0 +1,268 @@
+package logbook
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+)
+
+// SQLSource reads the logbook from its MySQL database, or anything else that
+// speaks the same SQL through database/sql, such as a copy in another database.
+type SQLSource struct {
+	db *sql.DB
+}
+
+// NewSQLSource ...
+func NewSQLSource(db *sql.DB) *SQLSource {
+	return &SQLSource{db: db}
+}
+
+// queryIDs returns the first column of the query as IDs
+func (source *SQLSource) queryIDs(query string, args ...interface{}) []int64 {
+	ids := make([]int64, 0)
+	rows, err := source.db.Query(query, args...)
+	check(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var id sql.NullInt64
+		check(rows.Scan(&id))
+		ids = append(ids, id.Int64)
+	}
+	check(rows.Err())
+	return ids
+}
+
+// Runs ...
+func (source *SQLSource) Runs(lower string, upper string, limit string) []Run {
+	runs := make([]Run, 0)
+	rows, err := source.db.Query("select * from logbook where run>=? and run<=? limit ?", lower, upper, limit)
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		runs = append(runs, scanner.Run())
+	}
+	check(rows.Err())
+	return runs
+}
+
+// RunsUpdatedSince ...
+func (source *SQLSource) RunsUpdatedSince(timestamp string, lower string, upper string) []Run {
+	runs := make([]Run, 0)
+	rows, err := source.db.Query("select * from logbook where time_update>=? and run>=? and run<=? order by time_update, run",
+		timestamp, lower, upper)
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		runs = append(runs, scanner.Run())
+	}
+	check(rows.Err())
+	return runs
+}
+
+// LatestTimestamps ...
+func (source *SQLSource) LatestTimestamps() Timestamps {
+	var runUpdated, commentCreated, fileCreated sql.NullString
+	check(source.db.QueryRow("SELECT (SELECT MAX(time_update) FROM logbook), "+
+		"(SELECT MAX(time_created) FROM logbook_comments), (SELECT MAX(time_created) FROM logbook_files)").
+		Scan(&runUpdated, &commentCreated, &fileCreated))
+	return Timestamps{
+		RunUpdated:     runUpdated.String,
+		CommentCreated: commentCreated.String,
+		FileCreated:    fileCreated.String,
+	}
+}
+
+// Comments ...
+func (source *SQLSource) Comments() []Comment {
+	comments := make([]Comment, 0)
+	rows, err := source.db.Query("select * from logbook_comments")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		comments = append(comments, scanner.Comment())
+	}
+	check(rows.Err())
+	return comments
+}
+
+// CommentsSince ...
+func (source *SQLSource) CommentsSince(timestamp string) []Comment {
+	comments := make([]Comment, 0)
+	rows, err := source.db.Query("select * from logbook_comments where time_created>=? order by time_created, id", timestamp)
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		comments = append(comments, scanner.Comment())
+	}
+	check(rows.Err())
+	return comments
+}
+
+// CommentKinds ...
+func (source *SQLSource) CommentKinds() []CommentKind {
+	columns := source.matchingColumns("logbook_comments", CommentKind{})
+	kinds := make([]CommentKind, 0)
+	rows, err := source.db.Query("SELECT DISTINCT " + strings.Join(columns, ", ") + " FROM logbook_comments")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		kinds = append(kinds, scanner.CommentKind())
+	}
+	check(rows.Err())
+	return kinds
+}
+
+// matchingColumns returns the columns of the table that match a field of row,
+// a struct like Comment, quoted for a select
+func (source *SQLSource) matchingColumns(table string, row interface{}) []string {
+	rows, err := source.db.Query("SELECT * FROM " + table + " LIMIT 0")
+	check(err)
+	defer rows.Close()
+	columns, err := rows.Columns()
+	check(err)
+
+	index := fieldIndex(reflect.TypeOf(row))
+	matching := make([]string, 0)
+	for _, column := range columns {
+		if _, exists := index[normalizeName(column)]; exists {
+			matching = append(matching, "`"+column+"`")
+		}
+	}
+	return matching
+}
+
+// Comment ...
+func (source *SQLSource) Comment(id int64) Comment {
+	rows, err := source.db.Query("select * from logbook_comments where id = ?", id)
+	check(err)
+	defer rows.Close()
+
+	var comment Comment
+	for rows.Next() {
+		comment = ScanComment(rows)
+	}
+	check(rows.Err())
+	return comment
+}
+
+// CommentLinks ...
+func (source *SQLSource) CommentLinks() []CommentLink {
+	links := make([]CommentLink, 0)
+	rows, err := source.db.Query("select id,parent,root_parent from logbook_comments order by id")
+	check(err)
+	defer rows.Close()
+
+	for rows.Next() {
+		var link CommentLink
+		check(rows.Scan(&link.ID, &link.Parent, &link.RootParent))
+		links = append(links, link)
+	}
+	check(rows.Err())
+	return links
+}
+
+// CommentFiles ...
+func (source *SQLSource) CommentFiles(commentID int64) []File {
+	files := make([]File, 0)
+	rows, err := source.db.Query("SELECT * FROM logbook_files WHERE commentid = ?", commentID)
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		files = append(files, scanner.File())
+	}
+	check(rows.Err())
+	return files
+}
+
+// CommentSubsystems ...
+func (source *SQLSource) CommentSubsystems(commentID int64) []int64 {
+	return source.queryIDs("select subsystemid from logbook_comments_subsystems where commentid=?", commentID)
+}
+
+// Files ...
+func (source *SQLSource) Files() []File {
+	files := make([]File, 0)
+	rows, err := source.db.Query("select * from logbook_files")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		files = append(files, scanner.File())
+	}
+	check(rows.Err())
+	return files
+}
+
+// FilesSince ...
+func (source *SQLSource) FilesSince(timestamp string) []File {
+	files := make([]File, 0)
+	rows, err := source.db.Query("select * from logbook_files where time_created>=? order by time_created, fileid", timestamp)
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		files = append(files, scanner.File())
+	}
+	check(rows.Err())
+	return files
+}
+
+// SubsystemLinks ...
+func (source *SQLSource) SubsystemLinks() []CommentSubsystems {
+	links := make([]CommentSubsystems, 0)
+	rows, err := source.db.Query("select * from logbook_comments_subsystems")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		links = append(links, scanner.CommentSubsystems())
+	}
+	check(rows.Err())
+	return links
+}
+
+// Users ...
+func (source *SQLSource) Users() []User {
+	users := make([]User, 0)
+	rows, err := source.db.Query("select * from logbook_users")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		users = append(users, scanner.User())
+	}
+	check(rows.Err())
+	return users
+}
+
+// Subsystems ...
+func (source *SQLSource) Subsystems() []Subsystem {
+	subsystems := make([]Subsystem, 0)
+	rows, err := source.db.Query("select * from logbook_subsystems")
+	check(err)
+	defer rows.Close()
+
+	scanner := NewScanner(rows)
+	for rows.Next() {
+		subsystems = append(subsystems, scanner.Subsystem())
+	}
+	check(rows.Err())
+	return subsystems
+}
@@ -1,42 +1,47 @@
 package main
 
 import (
-	"crypto/tls"
 	"database/sql"
-	"encoding/base64"
-	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	logsclient "github.com/SoftwareForScience/jiskefet-api-go/client/logs"
-	"github.com/SoftwareForScience/jiskefet-api-go/client/runs"
-	runsclient "github.com/SoftwareForScience/jiskefet-api-go/client/runs"
-	tagsclient "github.com/SoftwareForScience/jiskefet-api-go/client/tags"
-	"github.com/SoftwareForScience/jiskefet-api-go/models"
 	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
 	"github.com/go-openapi/runtime"
 	"github.com/go-openapi/runtime/client"
-	httptransport "github.com/go-openapi/runtime/client"
 	"github.com/go-openapi/strfmt"
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type Args struct {
-	username        string
-	password        string
-	logbookFilesDir string
-	logbookDB       DBArgs
-	jiskefetDB      DBArgs
-	parallel        bool
-	runtime         *client.Runtime
-	bearerToken     runtime.ClientAuthInfoWriter
+	username           string
+	password           string
+	logbookFilesDir    string
+	logbookDB          DBArgs
+	jiskefetDB         DBArgs
+	parallel           bool
+	userMerges         map[int64]int64   // Logbook user ID -> user ID it is merged into
+	anonymiser         *Anonymiser       // nil unless running in anonymisation mode
+	subsystemTags      string            // How the subsystem hierarchy ends up in tags, see subsystemTagsLeaf etc.
+	obsoleteSubsystems string            // What happens to obsolete subsystems, see obsoleteKeep etc.
+	subsystemRemap     map[string]string // Obsolete subsystem name -> successor name
+	orphans            string            // What happens to comments outside any thread, see orphansPromote etc.
+	onConflict         string            // What happens to users and subsystems that exist with other data, see conflictKeep etc.
+	filter             *commentFilter    // nil to migrate all threads
+	idMap              *idMap            // nil unless keeping track of migrated IDs
+	batchID            string            // ID of this migration run, see batchInfo
+	tagRules           *TagRules
+	tagCacheFile       string // Where tag IDs are persisted between runs, empty to not persist
+	jiskefetHost       string
+	strictTags         bool   // Verify every tag link by getting the log back
+	targetFile         string // Output file of the file target
+	report             *Report
+	runtime            *client.Runtime
+	bearerToken        runtime.ClientAuthInfoWriter
 }
 
 func check(err error) {
@@ -52,502 +57,388 @@ type DBArgs struct {
 	password string
 }
 
-func getLogbookSubsystems(logbookDB *sql.DB) []logbook.Subsystem {
-	subsystems := make([]logbook.Subsystem, 0)
-	{
-		rows, err := logbookDB.Query("select * from logbook_subsystems")
-		check(err)
-		defer rows.Close()
+func migrateLogbookRuns(args Args, source logbook.Source, target Target, runBoundLower string, runBoundUpper string, queryLimit string) {
+	for _, row := range source.Runs(runBoundLower, runBoundUpper, queryLimit) {
 
-		for rows.Next() {
-			subsystems = append(subsystems, logbook.ScanSubsystem(rows))
-		}
-		check(rows.Err())
-	}
-	return subsystems
-}
-
-func getLogbookSubsystemsMap(logbookDB *sql.DB) map[int64]logbook.Subsystem {
-	subsystems := make(map[int64]logbook.Subsystem)
-	{
-		rows, err := logbookDB.Query("select * from logbook_subsystems")
-		check(err)
-		defer rows.Close()
+		//log.Println("run = " + row.run)
+		//log.Printf("%+v\n", row)
 
-		for rows.Next() {
-			row := logbook.ScanSubsystem(rows)
-			subsystems[row.ID.Int64] = row
+		if args.idMap != nil && args.idMap.hasRun(row.Run.String) {
+			log.Printf("Run %s migrated before, skipped\n", row.Run.String)
+			continue
 		}
-		check(rows.Err())
+		migrateLogbookRun(args, row, target)
 	}
-	return subsystems
 }
 
-/// Returns list of SubsystemIDs associated with the commentID
-func getCommentSubsystems(commentID int64, logbookDB *sql.DB) []int64 {
-	subIDs := make([]int64, 0)
-	{
-		rows, err := logbookDB.Query("select subsystemid from logbook_comments_subsystems where commentid=?", commentID)
-		check(err)
-		defer rows.Close()
-		for rows.Next() {
-			var subsystemID sql.NullInt64
-			err := rows.Scan(&subsystemID)
-			check(err)
-			subIDs = append(subIDs, subsystemID.Int64)
-		}
-		check(rows.Err())
+func migrateLogbookRun(args Args, row logbook.Run, target Target) {
+	// Post data to Jiskefet
+	runNumber, err := target.CreateRun(TargetRun{
+		RunNumber:  row.Run.String,
+		NDetectors: row.NumberOfDetectors.Int64,
+		NFlps:      row.NumberOfLDCs.Int64,
+		NEpns:      row.NumberOfGDCs.Int64,
+	})
+	check(err)
+	log.Printf("Posted run %s as run %d\n", row.Run.String, runNumber)
+	args.report.countMigrated(func(counts *batchCounts) { counts.Runs++ })
+	if args.idMap != nil {
+		args.idMap.addRun(row.Run.String, runNumber)
 	}
-	return subIDs
 }
 
-func migrateLogbookRuns(args Args, logbookDB *sql.DB, runBoundLower string, runBoundUpper string, queryLimit string) {
-	// Initialize Jiskefet API
-	client := runsclient.New(args.runtime, strfmt.Default)
-
-	rows, err := logbookDB.Query("select * from logbook where run>=? and run<=? limit ?", runBoundLower, runBoundUpper, queryLimit)
-	check(err)
-	defer rows.Close()
-	for rows.Next() {
-		row := logbook.ScanRun(rows)
+func migrateLogbookComments(args Args, source logbook.Source, target Target) {
+	// Get Comment data from DB
+	log.Printf("Importing logbook_comments\n")
+	forest := buildThreadForest(args, source.CommentLinks(), args.orphans) // Hierarchy of the threads
 
-		//log.Println("run = " + row.run)
-		//log.Printf("%+v\n", row)
+	// Get subsystems, to translate into tags
+	subsystems := newSubsystemTree(args, logbook.SubsystemsMap(source)) // Use for tag names, logging only
 
-		// Post data to Jiskefet
-		startt, err := time.Parse(time.RFC3339, "2001-01-01T11:11:11Z")
-		check(err)
-		// endt, err := time.Parse(time.RFC3339, "2002-02-02T22:22:22Z")
-		// check(err)
-
-		start := strfmt.DateTime(startt)
-		// end := strfmt.DateTime(endt)
-		runType := "my-run-type"
-		// runQuality := "my-run-quality"
-		// activityId := "migrate"
-		// nSubtimeframes := int64(12312)
-		// bytesTimeframeBuilder := int64(512 * 1024)
-
-		params := runs.NewPostRunsParams()
-		params.CreateRunDto = new(models.CreateRunDto)
-		params.CreateRunDto.O2StartTime = &start
-		params.CreateRunDto.TrgStartTime = &start
-		params.CreateRunDto.RunType = &runType
-		// params.CreateRunDto.ActivityID = &activityId
-		params.CreateRunDto.NDetectors = &row.NumberOfDetectors.Int64
-		params.CreateRunDto.NFlps = &row.NumberOfLDCs.Int64
-		params.CreateRunDto.NEpns = &row.NumberOfGDCs.Int64
-
-		_, err = client.PostRuns(params, args.bearerToken)
-		check(err)
-	}
-	err = rows.Err()
-	check(err)
-}
+	// Get all tags we'll need up front, so the workers don't have to wait on each other for tag lookups
+	if preparer, ok := target.(tagPreparer); ok {
+		log.Printf("Preparing tags\n")
+		preparer.PrepareTags(getNeededTagTexts(args, source, subsystems))
+	}
 
-/// Gets all the comments that are roots (i.e. don't have parents)
-func getCommentRoots(logbookDB *sql.DB) []int64 {
-	roots := make([]int64, 0)
+	roots := forest.roots
+	if args.filter != nil {
+		roots = args.filter.selectThreads(source, forest, subsystems)
+	}
 
-	rows, err := logbookDB.Query("SELECT id FROM logbook_comments WHERE parent IS NULL")
-	check(err)
-	defer rows.Close()
+	var wg sync.WaitGroup
+	wg.Add(len(roots))
 
-	for rows.Next() {
-		var id int64
-		err := rows.Scan(&id)
-		check(err)
-		roots = append(roots, id)
+	log.Printf("Posting comments\n")
+	for i, logbookRootID := range roots {
+		f := func(i int, logbookRootID int64) {
+			defer wg.Done()
+			log.Printf("Thread #%d\n", i+1)
+			migrateLogbookThread(args, source, target, subsystems, forest, logbookRootID)
+		}
+		if args.parallel {
+			go f(i, logbookRootID)
+		} else {
+			f(i, logbookRootID)
+		}
 	}
-	check(rows.Err())
-
-	return roots
+	wg.Wait()
 }
 
-/// Gets all the comments that are children of the given root (i.e. belong to that thread)
-func getThreadComments(rootID int64, logbookDB *sql.DB) []int64 {
-	children := make([]int64, 0)
-
-	rows, err := logbookDB.Query("SELECT id FROM logbook_comments WHERE root_parent = ?", rootID)
-	check(err)
-	defer rows.Close()
-
-	for rows.Next() {
-		var id int64
-		err := rows.Scan(&id)
-		check(err)
-		children = append(children, id)
+/// Migrates a thread parent first, walking it with an explicit stack so deep
+/// threads don't exhaust the call stack. Comments in the ID map were migrated
+/// before, only their replies that are not in it yet are migrated.
+func migrateLogbookThread(args Args, source logbook.Source, target Target, subsystems *subsystemTree,
+	forest *threadForest, logbookRootID int64) {
+	type pending struct {
+		logbookID        int64
+		level            int
+		jiskefetParentID int64
+		jiskefetRootID   int64
 	}
-	check(rows.Err())
+	stack := []pending{{logbookRootID, 0, -1, -1}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		var jiskefetID int64
+		migrated := false
+		if args.idMap != nil {
+			jiskefetID, _, migrated = args.idMap.logIDs(current.logbookID)
+		}
+		if migrated {
+			log.Printf("Comment %d migrated before as Jiskefet.ID=%d, skipped\n", current.logbookID, jiskefetID)
+		} else {
+			jiskefetID = migrateLogbookComment(args, source, target, subsystems,
+				current.logbookID, current.level, current.jiskefetParentID, current.jiskefetRootID)
+		}
 
-	return children
+		// If we're the root, our ID is the parent and root for the children.
+		// If we're a child, we're parent to our children, but root stays the same.
+		jiskefetRootID := current.jiskefetRootID
+		if current.level == 0 {
+			jiskefetRootID = jiskefetID
+		}
+		children := forest.children[current.logbookID]
+		for j := len(children) - 1; j >= 0; j-- { // Reversed, so the first child is migrated first
+			stack = append(stack, pending{children[j], current.level + 1, jiskefetID, jiskefetRootID})
+		}
+	}
 }
 
-/// Make a map of a thread hierarchy
-func getCommentParentChildrenMap(rootID int64, logbookDB *sql.DB) map[int64][]int64 {
-	parentChildren := make(map[int64][]int64) // parent -> list of children
+/// Migrates one comment with its tags and attachments, and returns its ID in Jiskefet
+func migrateLogbookComment(args Args, source logbook.Source, target Target, subsystems *subsystemTree,
+	logbookID int64, level int, jiskefetParentID int64, jiskefetRootID int64) int64 {
+	comment := source.Comment(logbookID)
+	userID := canonicalUserID(args, comment.UserID.Int64)
+	if args.anonymiser != nil {
+		comment = args.anonymiser.Comment(comment)
+	}
 
-	rows, err := logbookDB.Query("select id,parent from logbook_comments")
-	check(err)
-	defer rows.Close()
+	// POST comment log
+	log.Printf("Logbook.ID=%d, Jiskefet.parentID=%d, Depth=%d ", logbookID, jiskefetParentID, level)
 
-	for rows.Next() {
-		var id int64
-		var parentID sql.NullInt64
-		err := rows.Scan(&id, &parentID)
-		check(err)
+	entry := TargetLog{
+		LogbookID: logbookID,
+		Title:     comment.Title.String,
+		Body:      comment.Comment.String,
+		Origin:    "human",
+		UserID:    userID,
+	}
+	var jiskefetID int64
+	var err error
+	if level == 0 {
+		// Necessary workaround for now... roots can only be runs
+		entry.Subtype = "run"
+		jiskefetID, err = target.CreateLog(entry)
+	} else {
+		entry.Subtype = "comment"
+		entry.ParentID = jiskefetParentID
+		entry.RootID = jiskefetRootID
+		jiskefetID, err = target.CreateComment(entry)
+	}
+	check(err)
 
-		if parentID.Valid {
-			parentChildren[parentID.Int64] = append(parentChildren[parentID.Int64], id)
+	log.Printf("Jiskefet.ID=%d\n", jiskefetID)
+	args.report.countMigrated(func(counts *batchCounts) { counts.Logs++ })
+	if args.idMap != nil {
+		if level == 0 {
+			args.idMap.addLog(logbookID, jiskefetID, jiskefetID)
+		} else {
+			args.idMap.addLog(logbookID, jiskefetID, jiskefetRootID)
 		}
 	}
-	check(rows.Err())
-
-	return parentChildren
-}
 
-func getComment(ID int64, logbookDB *sql.DB) logbook.Comment {
-	rows, err := logbookDB.Query("select * from logbook_comments where id = ?", ID)
-	check(err)
-	defer rows.Close()
+	log.Printf("Updating creation time\n")
+	check(warnNotSupported(target.SetCreationTime(jiskefetID, comment.TimeCreated.String), "Setting creation time"))
 
-	var comment logbook.Comment
-	for rows.Next() {
-		comment = logbook.ScanComment(rows)
+	log.Printf("Linking tags\n")
+	tagTexts := commentTagTexts(args, source, subsystems, logbookID, comment)
+	for _, tagText := range tagTexts {
+		log.Printf("Tag \"%s\"\n", tagText)
+		if err := target.LinkTag(jiskefetID, tagText); err != nil {
+			log.Printf("WARNING: Tag \"%s\" not linked: %s\n", tagText, err)
+			args.report.addFailedTagLink(logbookID, jiskefetID, tagText, err)
+		} else {
+			args.report.countMigrated(func(counts *batchCounts) { counts.TagLinks++ })
+			if args.idMap != nil {
+				args.idMap.addTagLink(jiskefetID, tagText)
+			}
+		}
+	}
+	// Not part of the contents, so updates leave it alone
+	batchTag := batchTagText(args.batchID)
+	if err := target.LinkTag(jiskefetID, batchTag); err != nil {
+		log.Printf("WARNING: Batch tag \"%s\" not linked: %s\n", batchTag, err)
+		args.report.addFailedTagLink(logbookID, jiskefetID, batchTag, err)
+	} else if args.idMap != nil {
+		args.idMap.addTagLink(jiskefetID, batchTag)
+	}
+	if args.idMap != nil {
+		args.idMap.setContents(logbookID, contentsOf(entry.Title, entry.Body, tagTexts))
 	}
 
-	check(rows.Err())
-	return comment
+	// Get Files from DB (note: doesn't contain the actual file, it's just metadata)
+	// log.Printf("Importing logbook_files\n")
+	files := source.CommentFiles(logbookID)
+	if len(files) > 0 {
+		// Post attachments to log
+		log.Printf("Uploading %d attachments\n", len(files))
+		for _, file := range files {
+			log.Printf("File \"%s\" (%.0f kB)\n", file.FileName.String, float64(file.Size.Int64)/1024.0)
+			uploadAttachment(args, jiskefetID, file, target)
+		}
+	}
+	return jiskefetID
 }
 
-func getCommentFiles(ID int64, logbookDB *sql.DB) []logbook.File {
-	files := make([]logbook.File, 0) // list of files
-	rows, err := logbookDB.Query("SELECT * FROM logbook_files WHERE commentid = ?", ID)
-	check(err)
-	defer rows.Close()
-
-	for rows.Next() {
-		file := logbook.ScanFile(rows)
-		files = append(files, file)
+/// Writes what the target still has buffered
+func flushTarget(target Target) {
+	if flusher, ok := target.(targetFlusher); ok {
+		check(flusher.Flush())
 	}
-	check(rows.Err())
-	return files
 }
 
-func updateJiskefetLogCreationTime(ID int64, logbookTimeCreated string, jiskefetDB *sql.DB) {
-	stmt, err := jiskefetDB.Prepare("UPDATE log SET creation_time=? WHERE log_id=?")
-	check(err)
-	_, err = stmt.Exec(logbookTimeCreated, ID)
-	check(err)
+/// Saves the ID map, with the tags the target created since the last save.
+/// Buffered writes are flushed first, so the map doesn't get ahead of Jiskefet.
+func saveIDMap(args Args, target Target, path string) {
+	flushTarget(target)
+	if creator, ok := target.(tagCreator); ok {
+		args.idMap.addCreatedTags(creator.CreatedTags())
+	}
+	args.idMap.save(path)
 }
 
-func linkTagToLog(logID int64, tagText string, client *tagsclient.Client, auth *runtime.ClientAuthInfoWriter,
-	tagIDCache *map[string]int64, tagIDCacheMutex *sync.Mutex) {
-
-	var tagID int64
+/// Saves the ID map after a migration failed part-way. A failing flush is
+/// only logged, the logs and attachments that were created are in Jiskefet
+/// either way and must not get lost from the map.
+func saveIDMapAfterFailure(args Args, target Target, path string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Saving the ID map after the failure: %v\n", r)
+		}
+	}()
 	func() {
-		defer (*tagIDCacheMutex).Unlock()
-		(*tagIDCacheMutex).Lock()
-		if _, exists := (*tagIDCache)[tagText]; !exists {
-			// Tag doesn't exist in cache
-			// Check if tag exists in Jiskefet
-			params := tagsclient.NewGetTagsParams()
-			params.TagText = &tagText
-			response, err := client.GetTags(params, *auth)
-			check(err)
-			resp := response.Payload.(map[string]interface{})
-			data := resp["data"].(map[string]interface{})
-			items := data["items"].([]interface{})
-			if len(items) > 0 {
-				// Tag exists, add ID to cache
-				item := items[0].(map[string]interface{})
-				tagID, err = item["tagId"].(json.Number).Int64()
-				check(err)
-			} else {
-				// If not, add tag to Jiskefet and ID to cache
-				params := tagsclient.NewPostTagsParams()
-				params.CreateTagDto = new(models.CreateTagDto)
-				params.CreateTagDto.TagText = &tagText
-				response, err := client.PostTags(params, *auth)
-				resp := response.Payload.(map[string]interface{})
-				data := resp["data"].(map[string]interface{})
-				item := data["item"].(map[string]interface{})
-				tagID, err = item["tagId"].(json.Number).Int64()
-				check(err)
-				log.Printf("Tag %s did not exist, added to Jiskefet with ID=%d", tagText, tagID)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("ERROR: Flushing the target after the failure: %v\n", r)
 			}
-			(*tagIDCache)[tagText] = tagID
-		} else {
-			tagID = (*tagIDCache)[tagText]
-		}
+		}()
+		flushTarget(target)
 	}()
-
-	// Add it to the log
-	params := tagsclient.NewPatchTagsIDLogsParams()
-	params.ID = tagID
-	params.LinkLogToTagDto = new(models.LinkLogToTagDto)
-	params.LinkLogToTagDto.LogID = &logID
-	// Disabled error check for now because status 200 is apparently seen as an error when it's actually fine
-	//  _, err := tagsClient.PatchTagsIDLogs(params, auth)
-	// check(err)
-	client.PatchTagsIDLogs(params, *auth)
+	if creator, ok := target.(tagCreator); ok {
+		args.idMap.addCreatedTags(creator.CreatedTags())
+	}
+	args.idMap.save(path)
 }
 
-func migrateLogbookComments(args Args, logbookDB *sql.DB, jiskefetDB *sql.DB) {
-	// Initialize Jiskefet API
-	logsClient := logsclient.New(args.runtime, strfmt.Default)
-	tagsClient := tagsclient.New(args.runtime, strfmt.Default)
-	auth := args.bearerToken
-
-	tagIDCache := make(map[string]int64) // Cache of tag text -> tag ID
-	var tagIDCacheMutex = sync.Mutex{}
-
-	// Get Comment data from DB
-	log.Printf("Importing logbook_comments\n")
-	roots := getCommentRoots(logbookDB) // IDs of thread roots
-
-	// Get subsystems, to translate into tags
-	subsystemsMap := getLogbookSubsystemsMap(logbookDB) // Use for tag names, logging only
-
-	var wg sync.WaitGroup
-	wg.Add(len(roots))
+/// Returns the tags a comment gets in Jiskefet
+func commentTagTexts(args Args, source logbook.Source, subsystems *subsystemTree, logbookID int64, comment logbook.Comment) []string {
+	return tagTextsOf(args, subsystems, comment, source.CommentSubsystems(logbookID))
+}
 
-	log.Printf("Posting comments\n")
-	for i, logbookRootID := range roots {
-		parentChildren := getCommentParentChildrenMap(logbookRootID, logbookDB) // Get hierarchy map of this thread
+/// Returns the tags a comment filed under the subsystems gets in Jiskefet
+func tagTextsOf(args Args, subsystems *subsystemTree, comment logbook.Comment, subsystemIDs []int64) []string {
+	// Add type tags to replace enum('GENERAL','HARDWARE','CAVERN','DQM/QA','SOFTWARE','NETWORK','EOS','DCS','OTHER')
+	tagTexts := args.tagRules.tagTexts(tagCategoryCommentType, comment.CommentType.String)
+	tagTexts = append(tagTexts, args.tagRules.tagTexts(tagCategoryClass, comment.Class.String)...)
+	tagTexts = append(tagTexts, args.tagRules.tagTexts(tagCategoryContext, comment.Context.String)...)
 
-		f := func(i int, logbookID int64) {
-			defer wg.Done()
-			// Recursion function to traverse parent -> child relations
-			var Recurse func(logbookID int64, level int, jiskefetParentID int64, jiskefetRootID int64)
-			Recurse = func(logbookID int64, level int, jiskefetParentID int64, jiskefetRootID int64) {
-				comment := getComment(logbookID, logbookDB)
-
-				// POST comment log
-				log.Printf("Thread #%d\n", i+1)
-				log.Printf("Logbook.ID=%d, Jiskefet.parentID=%d, Depth=%d ", logbookID, jiskefetParentID, level)
-
-				jiskefetID := int64(-1)
-				if level == 0 {
-					// Necessary workaround for now... roots can only be runs
-					// Post comment to root
-					// run := int64(0)
-					origin := "human"
-					subtype := "run"
-					params := logsclient.NewPostLogsParams()
-					params.CreateLogDto = new(models.CreateLogDto)
-					params.CreateLogDto.Attachments = make([]string, 0)
-					params.CreateLogDto.Body = &comment.Comment.String
-					params.CreateLogDto.Origin = &origin
-					params.CreateLogDto.Subtype = &subtype
-					params.CreateLogDto.Title = &comment.Title.String
-					params.CreateLogDto.User = &comment.UserID.Int64
-					response, err := logsClient.PostLogs(params, auth)
-					check(err)
-
-					// Get ID of POSTed log
-					resp := response.Payload.(map[string]interface{})
-					data := resp["data"].(map[string]interface{})
-					item := data["item"].(map[string]interface{})
-					id, err := item["logId"].(json.Number).Int64()
-					// jiskefetID := *response.Payload.LogID // Use this once response schema is fixed
-					check(err)
-					jiskefetID = id
-				} else {
-					// Post comment to root
-					// run := int64(0)
-					origin := "human"
-					subtype := "comment"
-					params := logsclient.NewPostLogsThreadsParams()
-					params.CreateCommentDto = new(models.CreateCommentDto)
-					params.CreateCommentDto.Attachments = make([]string, 0)
-					params.CreateCommentDto.Body = &comment.Comment.String
-					params.CreateCommentDto.Origin = &origin
-					params.CreateCommentDto.ParentID = &jiskefetParentID
-					params.CreateCommentDto.RootID = &jiskefetRootID
-					params.CreateCommentDto.Subtype = &subtype
-					params.CreateCommentDto.Title = &comment.Title.String
-					params.CreateCommentDto.User = &comment.UserID.Int64
-					response, err := logsClient.PostLogsThreads(params, auth)
-					check(err)
-
-					// Get ID of POSTed log
-					resp := response.Payload.(map[string]interface{})
-					data := resp["data"].(map[string]interface{})
-					item := data["item"].(map[string]interface{})
-					id, err := item["logId"].(json.Number).Int64()
-					// jiskefetID := *response.Payload.LogID // Use this once response schema is fixed
-					check(err)
-					jiskefetID = id
-				}
-
-				log.Printf("Jiskefet.ID=%d\n", jiskefetID)
-
-				log.Printf("Updating creation time\n")
-				updateJiskefetLogCreationTime(jiskefetID, comment.TimeCreated.String, jiskefetDB)
-
-				log.Printf("Linking comment type tag\n")
-				{
-					// Add type tags to replace enum('GENERAL','HARDWARE','CAVERN','DQM/QA','SOFTWARE','NETWORK','EOS','DCS','OTHER')
-					tagText := "COMMENT_TYPE/" + comment.CommentType.String
-					log.Printf("Tag \"%s\"\n", tagText)
-					linkTagToLog(jiskefetID, tagText, tagsClient, &auth, &tagIDCache, &tagIDCacheMutex)
-				}
-
-				log.Printf("Linking subsystem tag(s)\n")
-				{
-					subsystemIDs := getCommentSubsystems(logbookID, logbookDB)
-					for _, subsystemID := range subsystemIDs {
-						tagText := subsystemsMap[subsystemID].Name.String
-						log.Printf("Tag \"%s\"\n", tagText)
-						linkTagToLog(jiskefetID, tagText, tagsClient, &auth, &tagIDCache, &tagIDCacheMutex)
-					}
-				}
-
-				// Get Files from DB (note: doesn't contain the actual file, it's just metadata)
-				// log.Printf("Importing logbook_files\n")
-				files := getCommentFiles(logbookID, logbookDB)
-				if len(files) > 0 {
-					// Post attachments to log
-					log.Printf("Uploading %d attachments\n", len(files))
-					for _, file := range files {
-						log.Printf("File \"%s\" (%.0f kB)\n", file.FileName.String, float64(file.Size.Int64)/1024.0)
-						uploadAttachment(args, jiskefetID, file, logsClient, auth)
-					}
-				}
-
-				logbookChildrenIDs := parentChildren[logbookID]
-				for _, logbookChildID := range logbookChildrenIDs {
-					if level == 0 {
-						// If we're the root, our ID is the parent and root for the child
-						jiskefetParentID := jiskefetID
-						jiskefetRootID := jiskefetID
-						Recurse(logbookChildID, level+1, jiskefetParentID, jiskefetRootID)
-					} else {
-						// If we're a child, we're parent to our child, but root stays the same
-						jiskefetParentID := jiskefetID
-						Recurse(logbookChildID, level+1, jiskefetParentID, jiskefetRootID)
-					}
-				}
-			}
-
-			// Start off recursion for this thread root
-			Recurse(logbookID, 0, -1, -1)
+	for _, subsystemID := range subsystemIDs {
+		if _, exists := subsystems.subsystems[subsystemID]; !exists {
+			log.Printf("WARNING: Unknown subsystem %d, not linked\n", subsystemID)
 		}
-		if args.parallel {
-			go f(i, logbookRootID)
-		} else {
-			f(i, logbookRootID)
+		for _, subsystemTagText := range subsystems.tagTexts(subsystemID) {
+			tagTexts = append(tagTexts, args.tagRules.tagTexts(tagCategorySubsystem, subsystemTagText)...)
 		}
 	}
-	wg.Wait()
+	return uniqueTagTexts(tagTexts)
 }
 
-func uploadAttachment(args Args, logID int64, file logbook.File, client *logsclient.Client, auth runtime.ClientAuthInfoWriter) {
-	timeCreated := file.TimeCreated.String
-	timeSplit := strings.Split(timeCreated, "-")
+/// Returns where the logbook keeps the contents of the file:
+/// <files dir>/<year>-<month>/<comment ID>_<file ID>.<extension>
+func attachmentPath(filesDir string, file logbook.File) (string, error) {
+	timeSplit := strings.Split(file.TimeCreated.String, "-")
+	if len(timeSplit) < 2 {
+		return "", fmt.Errorf("file %d has invalid creation time \"%s\"", file.FileID.Int64, file.TimeCreated.String)
+	}
 	year := timeSplit[0]
 	month := timeSplit[1]
 
 	fileNameSplit := strings.Split(file.FileName.String, ".")
 	extension := fileNameSplit[len(fileNameSplit)-1]
 
-	path := fmt.Sprintf("%s/%s-%s/%d_%d.%s",
-		args.logbookFilesDir, year, month, file.CommentID.Int64, file.FileID.Int64, extension)
+	return fmt.Sprintf("%s/%s-%s/%d_%d.%s",
+		filesDir, year, month, file.CommentID.Int64, file.FileID.Int64, extension), nil
+}
+
+func uploadAttachment(args Args, logID int64, file logbook.File, target Target) {
+	path, err := attachmentPath(args.logbookFilesDir, file)
+	check(err)
 
 	log.Printf("Reading from \"%s\"", path)
 	fileBytes, err := ioutil.ReadFile(path)
 	check(err)
+	if args.anonymiser != nil {
+		file, fileBytes = args.anonymiser.File(file, fileBytes)
+	}
 
-	mime := file.ContentType.String
-	fileEncoded := base64.StdEncoding.EncodeToString([]byte(fileBytes))
-	creationTimeT, err := time.Parse(time.RFC3339, "2001-01-01T11:11:11Z")
+	fileID, err := target.AttachFile(logID, TargetAttachment{
+		FileName:    file.FileName.String,
+		Title:       file.Title.String,
+		Mime:        file.ContentType.String,
+		Data:        fileBytes,
+		TimeCreated: file.TimeCreated.String,
+	})
 	check(err)
-	creationTime := strfmt.DateTime(creationTimeT)
-
-	// log.Printf("        WARNING: Attachments disabled, work in progress..\n")
-	if mime == "image/jpeg" {
-		log.Printf("WARNING: Skipping jpeg image due to server bug\n")
-		return
-	}
-	if len(fileBytes) >= 8000 {
-		log.Printf("WARNING: Skipping large file (8kB+) due to server bug\n")
-		return
+	if fileID != 0 {
+		log.Printf("Attachment ID=%d\n", fileID)
+		args.report.countMigrated(func(counts *batchCounts) { counts.Attachments++ })
+		if args.idMap != nil {
+			args.idMap.addFile(file.FileID.Int64, fileID)
+		}
 	}
-	params := logsclient.NewPostLogsIDAttachmentsParams()
-	params.CreateAttachmentDto = new(models.CreateAttachmentDto)
-	params.CreateAttachmentDto.CreationTime = &creationTime
-	params.CreateAttachmentDto.FileData = &fileEncoded
-	params.CreateAttachmentDto.FileMime = &mime
-	params.CreateAttachmentDto.FileName = &file.FileName.String
-	params.CreateAttachmentDto.Title = file.Title.String
-	params.ID = logID
-	_, err = client.PostLogsIDAttachments(params, auth)
-	check(err)
 }
 
-func migrateLogbookSubsystems(args Args, logbookDB *sql.DB, jiskefetDB *sql.DB) {
-	// Unfortunately, we can't use the API for this, and need direct DB
-	// access.
-
+func migrateLogbookSubsystems(args Args, source logbook.Source, target Target) {
 	// Get Subsystems
-	logbookSubsystems := getLogbookSubsystems(logbookDB)
+	logbookSubsystems := source.Subsystems()
+	subsystems := newSubsystemTree(args, logbook.SubsystemsMap(source))
 	// log.Printf("Logbook subsystems:\n%+v\n", logbookSubsystems)
 
-	// Insert them into Jiskefet
+	targetSubsystems := make([]TargetSubsystem, 0, len(logbookSubsystems))
 	for _, subsystem := range logbookSubsystems {
-		log.Printf("Inserting \"%s\":", subsystem.Name.String)
-		stmt, err := jiskefetDB.Prepare("INSERT IGNORE INTO sub_system(subsystem_id, subsystem_name) VALUES(?,?)")
-		check(err)
-		res, err := stmt.Exec(subsystem.ID.Int64, subsystem.Name.String)
-		check(err)
-		lastID, err := res.LastInsertId()
-		check(err)
-		rowCnt, err := res.RowsAffected()
-		check(err)
-		if rowCnt == 0 {
-			log.Printf("Not inserted, possible duplicate\n")
-		} else {
-			log.Printf("Inserted ID %d, affected %d\n", lastID, rowCnt)
+		name := subsystems.name(subsystem.ID.Int64)
+		if !subsystems.migrated(subsystem.ID.Int64) {
+			log.Printf("Skipping obsolete \"%s\"\n", subsystem.Name.String)
+			continue
 		}
+		log.Printf("Inserting \"%s\" (%s)\n", name, strings.Join(subsystems.pathNames(subsystem.ID.Int64), " > "))
+		targetSubsystems = append(targetSubsystems, TargetSubsystem{
+			ID:          subsystem.ID.Int64,
+			Name:        name,
+			Description: subsystem.Text.String,
+		})
 	}
-}
 
-func migrateLogbookUsers(args Args, logbookDB *sql.DB, jiskefetDB *sql.DB) {
-	// Unfortunately, we can't use the API for this, and need direct DB
-	// access.
+	// Insert them into Jiskefet, all or nothing
+	results, err := target.UpsertSubsystems(targetSubsystems, args.onConflict)
+	if err == errNotSupported {
+		log.Printf("WARNING: Migrating subsystems %s\n", err)
+		return
+	}
+	check(err)
+	for i, subsystem := range targetSubsystems {
+		inserted := recordUpsert(args, "subsystem", subsystem.ID, subsystem.Name, results[i])
+		if inserted {
+			args.report.countMigrated(func(counts *batchCounts) { counts.Subsystems++ })
+		}
+		if args.idMap != nil {
+			args.idMap.addSubsystem(subsystem.ID, inserted)
+		}
+	}
+}
 
+func migrateLogbookUsers(args Args, source logbook.Source, target Target) {
 	// Get Logbook users
-	logbookUsers := make([]logbook.User, 0)
-	func() {
-		rows, err := logbookDB.Query("select * from logbook_users")
-		check(err)
-		defer rows.Close()
-
-		for rows.Next() {
-			logbookUsers = append(logbookUsers, logbook.ScanUser(rows))
-		}
-		check(rows.Err())
-	}()
+	logbookUsers := source.Users()
 	//log.Printf("Logbook users:\n%+v\n", logbookUsers)
 
-	// Insert them into Jiskefet
+	err := upsertLogbookUsers(args, logbookUsers, target)
+	if err == errNotSupported {
+		log.Printf("WARNING: Migrating users %s\n", err)
+		return
+	}
+	check(err)
+}
+
+/// Inserts the users into Jiskefet, all or nothing, except those that are
+/// merged into another user
+func upsertLogbookUsers(args Args, logbookUsers []logbook.User, target Target) error {
+	targetUsers := make([]TargetUser, 0, len(logbookUsers))
 	for _, user := range logbookUsers {
+		if into, merged := args.userMerges[user.ID.Int64]; merged {
+			log.Printf("Skipping \"%d\", merged into \"%d\"\n", user.ID.Int64, into)
+			continue
+		}
 		log.Printf("Inserting \"%d\"\n", user.ID.Int64)
-		stmt, err := jiskefetDB.Prepare("INSERT IGNORE INTO user(user_id, external_id, sams_id) VALUES(?,?,?)")
-		check(err)
-		res, err := stmt.Exec(user.ID.Int64, user.ID.Int64, user.ID.Int64)
-		check(err)
-		lastID, err := res.LastInsertId()
-		check(err)
-		rowCnt, err := res.RowsAffected()
-		check(err)
-		if rowCnt == 0 {
-			log.Printf("Not inserted, possible duplicate\n")
-		} else {
-			log.Printf("ID %d, affected %d\n", lastID, rowCnt)
+		targetUsers = append(targetUsers, TargetUser{ID: user.ID.Int64})
+	}
+
+	results, err := target.UpsertUsers(targetUsers, args.onConflict)
+	if err != nil {
+		return err
+	}
+	for i, user := range targetUsers {
+		inserted := recordUpsert(args, "user", user.ID, strconv.FormatInt(user.ID, 10), results[i])
+		if inserted {
+			args.report.countMigrated(func(counts *batchCounts) { counts.Users++ })
+		}
+		if args.idMap != nil {
+			args.idMap.addUser(user.ID, inserted)
 		}
 	}
+	return nil
 }
 
 func openDB(args DBArgs) *sql.DB {
@@ -577,68 +468,24 @@ func checkJiskefetConnection(args Args) {
 	check(err)
 }
 
-func main() {
-	queryLimit := flag.String("rlimit", "10", "Runs: Query result size limit")
-	runBoundLower := flag.String("rmin", "500", "Runs: Lower run number bound")
-	runBoundUpper := flag.String("rmax", "9999999", "Runs: Upper run number bound")
-	parallel := flag.Bool("parallel", false, "Use parallel requests")
-	tlsInsecureSkipVerify := flag.Bool("tlsskipverify", false, "Skip insecure TLS verification")
-
-	checkOnly := flag.Bool("check", false, "Run a connectivity check and exit")
-	migrateSubsystems := flag.Bool("msubsystems", false, "Migrate subsystems as subsystems & subsystem tags")
-	migrateUsers := flag.Bool("musers", false, "Migrate users")
-	migrateComments := flag.Bool("mcomments", false, "Migrate comments w. attachments & subsystem tags")
-	migrateRuns := flag.Bool("mruns", false, "Migrate runs")
-	flag.Parse()
-
-	var args Args
-	args.parallel = *parallel
-	args.runtime = httptransport.New(os.Getenv("JISKEFET_HOST"), os.Getenv("JISKEFET_PATH"), nil)
-	args.runtime.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *tlsInsecureSkipVerify}}
-
-	args.bearerToken = httptransport.BearerToken(os.Getenv("JISKEFET_API_TOKEN"))
-	args.logbookFilesDir = os.Getenv("JISKEFET_MIGRATE_LOGBOOKDB_FILESDIR")
-
-	args.jiskefetDB.dbName = os.Getenv("JISKEFET_MIGRATE_JISKEFETDB_DBNAME")
-	args.jiskefetDB.hostPort = os.Getenv("JISKEFET_MIGRATE_JISKEFETDB_HOSTPORT")
-	args.jiskefetDB.userName = os.Getenv("JISKEFET_MIGRATE_JISKEFETDB_USERNAME")
-	args.jiskefetDB.password = os.Getenv("JISKEFET_MIGRATE_JISKEFETDB_PASSWORD")
-
-	args.logbookDB.dbName = os.Getenv("JISKEFET_MIGRATE_LOGBOOKDB_DBNAME")
-	args.logbookDB.hostPort = os.Getenv("JISKEFET_MIGRATE_LOGBOOKDB_HOSTPORT")
-	args.logbookDB.userName = os.Getenv("JISKEFET_MIGRATE_LOGBOOKDB_USERNAME")
-	args.logbookDB.password = os.Getenv("JISKEFET_MIGRATE_LOGBOOKDB_PASSWORD")
-
-	log.Printf("Opening Logbook database\n")
-	logbookDB := openDB(args.logbookDB)
-	defer logbookDB.Close()
-	log.Printf("Opening Jiskefet database\n")
-	jiskefetDB := openDB(args.jiskefetDB)
-	defer jiskefetDB.Close()
-
-	if *checkOnly {
-		log.Printf("Checking Jiskefet connection\n")
-		checkJiskefetConnection(args)
-		return
+/// Refuses to migrate from a logbook schema the migrator can't read, or with
+/// enum values it doesn't know unless allowUnknownEnums is set
+func checkLogbookSchema(schema logbook.Schema, allowUnknownEnums bool) {
+	log.Printf("Logbook schema variant: %s\n", schema.Variant)
+	for _, note := range schema.Notes() {
+		log.Printf("Logbook schema: %s\n", note)
 	}
-
-	if *migrateSubsystems {
-		log.Printf("Migrating subsystems...\n")
-		migrateLogbookSubsystems(args, logbookDB, jiskefetDB)
+	for _, unexpected := range schema.Unexpected() {
+		log.Printf("WARNING: Logbook schema: %s\n", unexpected)
 	}
-
-	if *migrateUsers {
-		log.Printf("Migrating users...\n")
-		migrateLogbookUsers(args, logbookDB, jiskefetDB)
+	problems := schema.Problems()
+	for _, problem := range problems {
+		log.Printf("ERROR: Logbook schema: %s\n", problem)
 	}
-
-	if *migrateRuns {
-		log.Printf("Migrating runs...\n")
-		migrateLogbookRuns(args, logbookDB, *runBoundLower, *runBoundUpper, *queryLimit)
+	if len(problems) > 0 {
+		panic("Unsupported logbook schema")
 	}
-
-	if *migrateComments {
-		log.Printf("Migrating comments...\n")
-		migrateLogbookComments(args, logbookDB, jiskefetDB)
+	if len(schema.Unexpected()) > 0 && !allowUnknownEnums {
+		panic("Unknown enum values in logbook schema, check the tag rules and use -allowunknownenums to migrate them as they are")
 	}
 }
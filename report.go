@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+/// Things that went wrong during a migration without stopping it, written to
+/// a JSON file at the end so they can be fixed up afterwards.
+/// Safe for use by parallel workers.
+type Report struct {
+	mutex           sync.Mutex
+	Started         string           `json:"started"`
+	Finished        string           `json:"finished"`
+	Migrated        batchCounts      `json:"migrated"`
+	FailedTagLinks  []FailedTagLink  `json:"failedTagLinks"`
+	OrphanedThreads []OrphanedThread `json:"orphanedThreads"`
+	UpdatedLogs     []UpdatedLog     `json:"updatedLogs"`
+	Duplicates      []UpsertRow      `json:"duplicates"` // Users and subsystems in Jiskefet already, with the same data
+	Conflicts       []UpsertConflict `json:"conflicts"`  // Users and subsystems in Jiskefet already, with other data
+}
+
+/// A tag that could not be linked to a migrated log
+type FailedTagLink struct {
+	LogbookID int64  `json:"logbookId"`
+	LogID     int64  `json:"logId"`
+	TagText   string `json:"tagText"`
+	Error     string `json:"error"`
+}
+
+/// Comments that could not be reached from a thread root, and what was done
+/// with them, see orphansPromote etc.
+type OrphanedThread struct {
+	LogbookID int64   `json:"logbookId"` // Top of the subthread
+	ParentID  int64   `json:"parentId"`  // Logbook parent that is missing, or that closes the loop
+	Problem   string  `json:"problem"`   // "orphan" or "cycle"
+	Action    string  `json:"action"`
+	Comments  []int64 `json:"comments"` // All comments in the subthread
+}
+
+/// Edits to a logbook comment that were carried over to its log, or that
+/// failed to be if Error is set. The old body is not known, only that it changed.
+type UpdatedLog struct {
+	LogbookID   int64    `json:"logbookId"`
+	LogID       int64    `json:"logId"`
+	Changed     []string `json:"changed"`               // "title", "body"
+	TitleBefore string   `json:"titleBefore,omitempty"` // Only if the title changed
+	TitleAfter  string   `json:"titleAfter,omitempty"`
+	TagsBefore  []string `json:"tagsBefore"`
+	TagsAfter   []string `json:"tagsAfter"`
+	TagsAdded   []string `json:"tagsAdded"`
+	TagsRemoved []string `json:"tagsRemoved"`
+	Error       string   `json:"error,omitempty"`
+}
+
+/// A user or subsystem
+type UpsertRow struct {
+	Kind string `json:"kind"` // "user" or "subsystem"
+	ID   int64  `json:"id"`
+}
+
+/// A user or subsystem that was in Jiskefet already with other data, and
+/// whether that data was kept or overwritten
+type UpsertConflict struct {
+	UpsertRow
+	UpsertResult
+}
+
+func newReport() *Report {
+	return &Report{
+		Started:         time.Now().UTC().Format(time.RFC3339),
+		FailedTagLinks:  make([]FailedTagLink, 0),
+		OrphanedThreads: make([]OrphanedThread, 0),
+		UpdatedLogs:     make([]UpdatedLog, 0),
+		Duplicates:      make([]UpsertRow, 0),
+		Conflicts:       make([]UpsertConflict, 0),
+	}
+}
+
+/// Counts something that was migrated, e.g.
+/// report.countMigrated(func(counts *batchCounts) { counts.Logs++ })
+func (report *Report) countMigrated(update func(counts *batchCounts)) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	update(&report.Migrated)
+}
+
+func (report *Report) counts() batchCounts {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	return report.Migrated
+}
+
+func (report *Report) addFailedTagLink(logbookID int64, logID int64, tagText string, err error) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.FailedTagLinks = append(report.FailedTagLinks, FailedTagLink{
+		LogbookID: logbookID,
+		LogID:     logID,
+		TagText:   tagText,
+		Error:     err.Error(),
+	})
+}
+
+func (report *Report) addOrphanedThread(logbookID int64, parentID int64, problem string, action string, comments []int64) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.OrphanedThreads = append(report.OrphanedThreads, OrphanedThread{
+		LogbookID: logbookID,
+		ParentID:  parentID,
+		Problem:   problem,
+		Action:    action,
+		Comments:  comments,
+	})
+}
+
+func (report *Report) addUpdatedLog(change UpdatedLog) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.UpdatedLogs = append(report.UpdatedLogs, change)
+}
+
+func (report *Report) addUpsertDuplicate(kind string, id int64) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Duplicates = append(report.Duplicates, UpsertRow{Kind: kind, ID: id})
+}
+
+func (report *Report) addUpsertConflict(kind string, id int64, result UpsertResult) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Conflicts = append(report.Conflicts, UpsertConflict{UpsertRow{Kind: kind, ID: id}, result})
+}
+
+/// Logs a summary, and writes the full report if a path is given
+func (report *Report) write(path string) {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+	report.Finished = time.Now().UTC().Format(time.RFC3339)
+
+	log.Printf("Report: %d failed tag links, %d orphaned threads, %d updated logs, %d duplicates, %d conflicts\n",
+		len(report.FailedTagLinks), len(report.OrphanedThreads), len(report.UpdatedLogs),
+		len(report.Duplicates), len(report.Conflicts))
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	check(err)
+	check(ioutil.WriteFile(path, data, 0644))
+	log.Printf("Wrote report to \"%s\"\n", path)
+}
+
+/// Writes the report after a migration failed part-way, so the problems found
+/// until then are not lost. A failing write is only logged, the failure
+/// itself is what is reported to the user.
+func (report *Report) writeAfterFailure(path string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: Writing the report after the failure: %v\n", r)
+		}
+	}()
+	report.write(path)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The Jiskefet API clients return response bodies as untyped payloads, of the
+// form {"data": {"item": {...}}} for a single object, or
+// {"data": {"items": [...]}} for a list. These helpers decode them into typed
+// structs, with an error naming the operation and field when the schema isn't
+// what we expect, instead of a panic on a failed type assertion.
+
+/// A log in a response. Tags are only present in some responses.
+type logResponse struct {
+	LogID *int64        `json:"logId"`
+	Tags  []tagResponse `json:"tags"`
+}
+
+/// A tag in a response
+type tagResponse struct {
+	TagID   *int64  `json:"tagId"`
+	TagText *string `json:"tagText"`
+}
+
+/// A run in a response
+type runResponse struct {
+	RunNumber *int64 `json:"runNumber"`
+}
+
+/// An attachment in a response
+type attachmentResponse struct {
+	FileID *int64 `json:"fileId"`
+}
+
+type responseEnvelope struct {
+	Data *struct {
+		Item  json.RawMessage `json:"item"`
+		Items json.RawMessage `json:"items"`
+	} `json:"data"`
+}
+
+func decodeEnvelope(operation string, payload interface{}) (responseEnvelope, error) {
+	var envelope responseEnvelope
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return envelope, fmt.Errorf("%s: can't read response: %s", operation, err)
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return envelope, fmt.Errorf("%s: unexpected response: %s", operation, err)
+	}
+	if envelope.Data == nil {
+		return envelope, fmt.Errorf("%s: response has no \"data\"", operation)
+	}
+	return envelope, nil
+}
+
+func isMissing(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
+
+/// Decodes data.item of the payload into item
+func decodeItem(operation string, payload interface{}, item interface{}) error {
+	envelope, err := decodeEnvelope(operation, payload)
+	if err != nil {
+		return err
+	}
+	if isMissing(envelope.Data.Item) {
+		return fmt.Errorf("%s: response has no \"data.item\"", operation)
+	}
+	if err := json.Unmarshal(envelope.Data.Item, item); err != nil {
+		return fmt.Errorf("%s: unexpected \"data.item\": %s", operation, err)
+	}
+	return nil
+}
+
+/// Decodes data.items of the payload into items, which must be a pointer to a slice
+func decodeItems(operation string, payload interface{}, items interface{}) error {
+	envelope, err := decodeEnvelope(operation, payload)
+	if err != nil {
+		return err
+	}
+	if isMissing(envelope.Data.Items) {
+		return fmt.Errorf("%s: response has no \"data.items\"", operation)
+	}
+	if err := json.Unmarshal(envelope.Data.Items, items); err != nil {
+		return fmt.Errorf("%s: unexpected \"data.items\": %s", operation, err)
+	}
+	return nil
+}
+
+func (tag tagResponse) check(operation string) error {
+	if tag.TagID == nil {
+		return fmt.Errorf("%s: tag has no \"tagId\"", operation)
+	}
+	if tag.TagText == nil {
+		return fmt.Errorf("%s: tag %d has no \"tagText\"", operation, *tag.TagID)
+	}
+	return nil
+}
+
+/// Returns the log of a single log response
+func decodeLog(operation string, payload interface{}) (logResponse, error) {
+	var item logResponse
+	if err := decodeItem(operation, payload, &item); err != nil {
+		return item, err
+	}
+	if item.LogID == nil {
+		return item, fmt.Errorf("%s: log has no \"logId\"", operation)
+	}
+	return item, nil
+}
+
+/// Returns the ID of the log in a single log response
+func decodeLogID(operation string, payload interface{}) (int64, error) {
+	item, err := decodeLog(operation, payload)
+	if err != nil {
+		return 0, err
+	}
+	return *item.LogID, nil
+}
+
+/// Returns the tag of a single tag response
+func decodeTag(operation string, payload interface{}) (tagResponse, error) {
+	var item tagResponse
+	if err := decodeItem(operation, payload, &item); err != nil {
+		return item, err
+	}
+	if item.TagID == nil {
+		return item, fmt.Errorf("%s: tag has no \"tagId\"", operation)
+	}
+	return item, nil
+}
+
+/// Returns the tags of a tag list response
+func decodeTags(operation string, payload interface{}) ([]tagResponse, error) {
+	items := make([]tagResponse, 0)
+	if err := decodeItems(operation, payload, &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if err := item.check(operation); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+/// Returns the run number of a single run response
+func decodeRunNumber(operation string, payload interface{}) (int64, error) {
+	var item runResponse
+	if err := decodeItem(operation, payload, &item); err != nil {
+		return 0, err
+	}
+	if item.RunNumber == nil {
+		return 0, fmt.Errorf("%s: run has no \"runNumber\"", operation)
+	}
+	return *item.RunNumber, nil
+}
+
+/// Returns the ID of the attachment of a single attachment response
+func decodeAttachmentID(operation string, payload interface{}) (int64, error) {
+	var item attachmentResponse
+	if err := decodeItem(operation, payload, &item); err != nil {
+		return 0, err
+	}
+	if item.FileID == nil {
+		return 0, fmt.Errorf("%s: attachment has no \"fileId\"", operation)
+	}
+	return *item.FileID, nil
+}
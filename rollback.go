@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+/// Deletes what a migration batch created from the Jiskefet DB: tag links,
+/// attachments, logs and runs, and with withCreated also the tags, users and
+/// subsystems the batch created. Things that existed before the batch are not
+/// touched. Edits made by updates are not undone. With dryRun it only logs
+/// what it would delete. Deleted tags are also removed from the tag cache at
+/// tagCacheFile, if given, so the next run doesn't link to them. The batch
+/// stays in the migration_batch table, as rolled back.
+func rollbackBatch(args Args, jiskefetDB *sql.DB, idMapFile string, tagCacheFile string, batchID string,
+	withCreated bool, dryRun bool) {
+	ids := args.idMap
+	if ids.Target == targetFile {
+		panic("The ID map is for the file target, there is nothing in Jiskefet to roll back")
+	}
+	batch, exists := ids.Batches[batchID]
+	if !exists {
+		batchIDs := make([]string, 0, len(ids.Batches))
+		for id := range ids.Batches {
+			batchIDs = append(batchIDs, id)
+		}
+		sort.Strings(batchIDs)
+		panic(fmt.Sprintf("No batch \"%s\" in the ID map, it has: %s", batchID, strings.Join(batchIDs, ", ")))
+	}
+
+	log.Printf("Batch \"%s\" from %s: %d logs, %d attachments, %d tag links, %d runs, %d tags, %d users, %d subsystems\n",
+		batchID, batch.Started, len(batch.Logs), len(batch.Attachments), len(batch.TagLinks), len(batch.Runs),
+		len(batch.Tags), len(batch.Users), len(batch.Subsystems))
+	if !withCreated {
+		log.Printf("Keeping the tags, users and subsystems the batch created\n")
+	}
+	if dryRun {
+		log.Printf("Dry run, nothing is deleted\n")
+	}
+
+	// All or nothing, so a failed rollback can simply be run again
+	var tx *sql.Tx
+	if !dryRun {
+		var err error
+		tx, err = jiskefetDB.Begin()
+		check(err)
+	}
+	deleted := 0
+	exec := func(what string, query string, values ...interface{}) int64 {
+		if dryRun {
+			log.Printf("Would delete %s\n", what)
+			return 0
+		}
+		res, err := tx.Exec(query, values...)
+		if err != nil {
+			check(tx.Rollback())
+			panic(fmt.Sprintf("Deleting %s: %s", what, err))
+		}
+		count, err := res.RowsAffected()
+		check(err)
+		if count == 0 {
+			log.Printf("WARNING: Nothing deleted for %s, already gone or still in use\n", what)
+		}
+		deleted += int(count)
+		return count
+	}
+
+	for _, link := range batch.TagLinks {
+		exec(fmt.Sprintf("tag \"%s\" of log %d", link.Tag, link.LogID),
+			"DELETE tags_logs FROM tags_logs JOIN tags ON tags.tag_id = tags_logs.fk_tag_id "+
+				"WHERE tags.tag_text = ? AND tags_logs.fk_log_id = ?", link.Tag, link.LogID)
+	}
+	for _, attachmentID := range batch.Attachments {
+		exec(fmt.Sprintf("attachment %d", attachmentID), "DELETE FROM attachment WHERE file_id = ?", attachmentID)
+	}
+	// Replies before their parents
+	for i := len(batch.Logs) - 1; i >= 0; i-- {
+		exec(fmt.Sprintf("log %d", batch.Logs[i]), "DELETE FROM log WHERE log_id = ?", batch.Logs[i])
+	}
+	for _, runNumber := range batch.Runs {
+		exec(fmt.Sprintf("run %d", runNumber), "DELETE FROM run WHERE run_number = ?", runNumber)
+	}
+	deletedTags := make([]string, 0)
+	if withCreated {
+		for _, tagText := range batch.Tags {
+			count := exec(fmt.Sprintf("tag \"%s\"", tagText), "DELETE FROM tags WHERE tag_text = ? AND "+
+				"NOT EXISTS (SELECT 1 FROM tags_logs WHERE tags_logs.fk_tag_id = tags.tag_id)", tagText)
+			if count > 0 {
+				deletedTags = append(deletedTags, tagText)
+			}
+		}
+		for _, userID := range batch.Users {
+			exec(fmt.Sprintf("user %d", userID), "DELETE FROM user WHERE user_id = ?", userID)
+		}
+		for _, subsystemID := range batch.Subsystems {
+			exec(fmt.Sprintf("subsystem %d", subsystemID), "DELETE FROM sub_system WHERE subsystem_id = ?", subsystemID)
+		}
+	}
+
+	if dryRun {
+		return
+	}
+	markRolledBack(tx, batchID)
+	check(tx.Commit())
+	log.Printf("Deleted %d rows\n", deleted)
+
+	ids.forgetBatch(batchID, withCreated)
+	ids.save(idMapFile)
+
+	if tagCacheFile != "" && len(deletedTags) > 0 {
+		cache := newTagCache(nil, nil)
+		if cache.load(tagCacheFile, args.jiskefetHost) {
+			cache.forget(deletedTags)
+			cache.save(tagCacheFile, args.jiskefetHost)
+		}
+	} else if len(deletedTags) > 0 {
+		log.Printf("WARNING: Deleted %d tags, if migrations use a -tagcache, give it to rollback too\n", len(deletedTags))
+	}
+}
+
+/// Records in the migration_batch table that the batch was rolled back, if it
+/// is in there. Batches of the API target are not.
+func markRolledBack(tx *sql.Tx, batchID string) {
+	var tables int
+	err := tx.QueryRow("SELECT COUNT(*) FROM information_schema.tables " +
+		"WHERE table_schema = DATABASE() AND table_name = 'migration_batch'").Scan(&tables)
+	if err == nil && tables > 0 {
+		var res sql.Result
+		res, err = tx.Exec("UPDATE migration_batch SET status = ? WHERE batch_id = ?", "rolled back", batchID)
+		if err == nil {
+			if count, _ := res.RowsAffected(); count == 0 {
+				log.Printf("WARNING: Batch \"%s\" is not in the migration_batch table\n", batchID)
+			}
+		}
+	}
+	if err != nil {
+		check(tx.Rollback())
+		panic(fmt.Sprintf("Marking batch \"%s\" as rolled back: %s", batchID, err))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+// Jiskefet has no subscription/notification tables yet, so the notification
+// settings of the logbook subsystems are exported to a JSON file instead, to
+// be imported once it does.
+
+/// Export format of the notification settings of all subsystems
+type SubscriptionsExport struct {
+	Generated  string                  `json:"generated"`
+	SourceDB   string                  `json:"sourceDb"`
+	Subsystems []SubsystemSubscription `json:"subsystems"`
+}
+
+/// Who gets notified about what for one subsystem
+type SubsystemSubscription struct {
+	SubsystemID       int64    `json:"subsystemId"`
+	Name              string   `json:"name"`
+	JiskefetName      string   `json:"jiskefetName"` // Subsystem name in Jiskefet, depends on -subsystemtags
+	Tags              []string `json:"tags"`         // Tags that logs of this subsystem get in Jiskefet
+	Obsolete          bool     `json:"obsolete"`
+	Recipients        []string `json:"recipients"`        // From Email
+	ProcessRecipients []string `json:"processRecipients"` // From EmailProcess
+
+	NotifyNoRunLogEntries    bool   `json:"notifyNoRunLogEntries"`
+	NotifyRunLogEntries      bool   `json:"notifyRunLogEntries"`
+	NotifyQualityFlags       bool   `json:"notifyQualityFlags"`
+	NotifyGlobalQualityFlags bool   `json:"notifyGlobalQualityFlags"`
+	NotifyProcessLogEntries  string `json:"notifyProcessLogEntries"`
+}
+
+/// Splits a logbook email field, which can hold several addresses separated
+/// by commas, semicolons or whitespace
+func splitRecipients(field string) []string {
+	return strings.FieldsFunc(field, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+func exportLogbookSubscriptions(args Args, source logbook.Source, path string) {
+	subsystems := newSubsystemTree(args, logbook.SubsystemsMap(source))
+
+	export := SubscriptionsExport{
+		Generated:  time.Now().UTC().Format(time.RFC3339),
+		SourceDB:   args.logbookDB.dbName,
+		Subsystems: make([]SubsystemSubscription, 0),
+	}
+	for _, subsystem := range source.Subsystems() {
+		email, emailProcess := subsystem.Email.String, subsystem.EmailProcess.String
+		if args.anonymiser != nil {
+			email, emailProcess = args.anonymiser.Text(email), args.anonymiser.Text(emailProcess)
+		}
+		id := subsystem.ID.Int64
+		subscription := SubsystemSubscription{
+			SubsystemID:              id,
+			Name:                     subsystem.Name.String,
+			JiskefetName:             subsystems.name(id),
+			Tags:                     subsystems.tagTexts(id),
+			Obsolete:                 isObsolete(subsystem),
+			Recipients:               splitRecipients(email),
+			ProcessRecipients:        splitRecipients(emailProcess),
+			NotifyNoRunLogEntries:    subsystem.NotifyNoRunLogEntries.Int64 != 0,
+			NotifyRunLogEntries:      subsystem.NotifyRunLogEntries.Int64 != 0,
+			NotifyQualityFlags:       subsystem.NotifyQualityFlags.Int64 != 0,
+			NotifyGlobalQualityFlags: subsystem.NotifyGlobalQualityFlags.Int64 != 0,
+			NotifyProcessLogEntries:  subsystem.NotifyProcessLogEntries.String,
+		}
+		if subscription.Tags == nil {
+			subscription.Tags = make([]string, 0)
+		}
+		log.Printf("Subsystem \"%s\": %d recipients, %d process recipients\n",
+			subscription.Name, len(subscription.Recipients), len(subscription.ProcessRecipients))
+		export.Subsystems = append(export.Subsystems, subscription)
+	}
+	sort.Slice(export.Subsystems, func(i, j int) bool {
+		return export.Subsystems[i].SubsystemID < export.Subsystems[j].SubsystemID
+	})
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	check(err)
+	check(ioutil.WriteFile(path, data, 0644))
+	log.Printf("Wrote notification settings of %d subsystems to \"%s\"\n", len(export.Subsystems), path)
+}
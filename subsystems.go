@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+// How the subsystem hierarchy is represented in the tags of a log
+const (
+	subsystemTagsLeaf      = "leaf"      // Only the subsystem's own name, e.g. "SPD"
+	subsystemTagsPath      = "path"      // The full path, e.g. "ITS/SPD"
+	subsystemTagsAncestors = "ancestors" // The subsystem's own name plus one tag per ancestor, e.g. "SPD" and "ITS"
+)
+
+// What happens to subsystems marked as obsolete in the logbook
+const (
+	obsoleteKeep   = "keep"   // Migrate them like any other subsystem
+	obsoleteSkip   = "skip"   // Don't migrate them, and don't link their tags
+	obsoleteRemap  = "remap"  // Don't migrate them, link the tags of their successor instead
+	obsoletePrefix = "prefix" // Migrate them with obsoletePrefixText in front of the name
+)
+
+const obsoletePrefixText = "OBSOLETE/"
+
+func checkSubsystemTagsMode(mode string) {
+	switch mode {
+	case subsystemTagsLeaf, subsystemTagsPath, subsystemTagsAncestors:
+	default:
+		panic(fmt.Sprintf("Unknown subsystem tag mode \"%s\", expected %s, %s or %s",
+			mode, subsystemTagsLeaf, subsystemTagsPath, subsystemTagsAncestors))
+	}
+}
+
+func checkObsoleteSubsystemsMode(mode string) {
+	switch mode {
+	case obsoleteKeep, obsoleteSkip, obsoleteRemap, obsoletePrefix:
+	default:
+		panic(fmt.Sprintf("Unknown obsolete subsystem mode \"%s\", expected %s, %s, %s or %s",
+			mode, obsoleteKeep, obsoleteSkip, obsoleteRemap, obsoletePrefix))
+	}
+}
+
+/// Reads the obsolete subsystem -> successor mapping, a JSON object of names.
+/// Example file:
+///   {"SPD_OLD": "SPD", "TRACKING": "ITS"}
+func loadSubsystemRemap(path string) map[string]string {
+	data, err := ioutil.ReadFile(path)
+	check(err)
+	remap := make(map[string]string)
+	check(json.Unmarshal(data, &remap))
+	return remap
+}
+
+/// The logbook subsystems, with the rules for how they end up in Jiskefet
+type subsystemTree struct {
+	subsystems   map[int64]logbook.Subsystem
+	tagsMode     string
+	obsoleteMode string
+	successors   map[int64]int64 // Obsolete subsystem ID -> successor ID, for obsoleteRemap
+}
+
+func newSubsystemTree(args Args, subsystems map[int64]logbook.Subsystem) *subsystemTree {
+	tree := &subsystemTree{
+		subsystems:   subsystems,
+		tagsMode:     args.subsystemTags,
+		obsoleteMode: args.obsoleteSubsystems,
+		successors:   make(map[int64]int64),
+	}
+	if tree.obsoleteMode != obsoleteRemap {
+		return tree
+	}
+
+	// Resolve successor names to IDs, and refuse to start with obsolete subsystems we can't place
+	byName := make(map[string]int64)
+	for id, subsystem := range subsystems {
+		byName[subsystem.Name.String] = id
+	}
+	for id, subsystem := range subsystems {
+		if !isObsolete(subsystem) {
+			continue
+		}
+		successorName, mapped := args.subsystemRemap[subsystem.Name.String]
+		if !mapped {
+			panic(fmt.Sprintf("No successor configured for obsolete subsystem \"%s\"", subsystem.Name.String))
+		}
+		successorID, exists := byName[successorName]
+		if !exists {
+			panic(fmt.Sprintf("Successor \"%s\" of obsolete subsystem \"%s\" does not exist", successorName, subsystem.Name.String))
+		}
+		if isObsolete(subsystems[successorID]) {
+			panic(fmt.Sprintf("Successor \"%s\" of obsolete subsystem \"%s\" is obsolete itself", successorName, subsystem.Name.String))
+		}
+		tree.successors[id] = successorID
+	}
+	return tree
+}
+
+func isObsolete(subsystem logbook.Subsystem) bool {
+	return subsystem.Obsolete.Valid && subsystem.Obsolete.Int64 != 0
+}
+
+/// Returns whether the subsystem itself should be inserted into Jiskefet
+func (tree *subsystemTree) migrated(id int64) bool {
+	if !isObsolete(tree.subsystems[id]) {
+		return true
+	}
+	return tree.obsoleteMode == obsoleteKeep || tree.obsoleteMode == obsoletePrefix
+}
+
+/// Returns the subsystems from the root of the hierarchy down to the given
+/// subsystem. Parents that don't exist end the path, and so does a cycle in
+/// the Parent links.
+func (tree *subsystemTree) path(id int64) []logbook.Subsystem {
+	path := make([]logbook.Subsystem, 0)
+	seen := make(map[int64]bool)
+	for {
+		subsystem, exists := tree.subsystems[id]
+		if !exists || seen[id] {
+			break
+		}
+		seen[id] = true
+		path = append([]logbook.Subsystem{subsystem}, path...)
+		if !subsystem.Parent.Valid {
+			break
+		}
+		id = subsystem.Parent.Int64
+	}
+	return path
+}
+
+/// Returns the path as names, e.g. ["ITS", "SPD"]
+func (tree *subsystemTree) pathNames(id int64) []string {
+	names := make([]string, 0)
+	for _, subsystem := range tree.path(id) {
+		names = append(names, subsystem.Name.String)
+	}
+	return names
+}
+
+func (tree *subsystemTree) prefixed(subsystem logbook.Subsystem, name string) string {
+	if tree.obsoleteMode == obsoletePrefix && isObsolete(subsystem) {
+		return obsoletePrefixText + name
+	}
+	return name
+}
+
+/// Returns the name the subsystem gets in Jiskefet
+func (tree *subsystemTree) name(id int64) string {
+	subsystem := tree.subsystems[id]
+	if tree.tagsMode == subsystemTagsPath {
+		return tree.prefixed(subsystem, strings.Join(tree.pathNames(id), "/"))
+	}
+	return tree.prefixed(subsystem, subsystem.Name.String)
+}
+
+/// Returns the tag texts to link to a log filed under the given subsystem,
+/// leaf first
+func (tree *subsystemTree) tagTexts(id int64) []string {
+	if subsystem, exists := tree.subsystems[id]; exists && isObsolete(subsystem) {
+		switch tree.obsoleteMode {
+		case obsoleteSkip:
+			log.Printf("Skipping obsolete subsystem \"%s\"\n", subsystem.Name.String)
+			return nil
+		case obsoleteRemap:
+			log.Printf("Obsolete subsystem \"%s\" remapped to \"%s\"\n",
+				subsystem.Name.String, tree.subsystems[tree.successors[id]].Name.String)
+			id = tree.successors[id]
+		}
+	}
+
+	path := tree.path(id)
+	if len(path) == 0 {
+		return nil
+	}
+	switch tree.tagsMode {
+	case subsystemTagsPath:
+		return []string{tree.name(id)}
+	case subsystemTagsAncestors:
+		// The obsolete mode applies to the ancestors as well
+		tags := make([]string, 0, len(path))
+		for i := len(path) - 1; i >= 0; i-- {
+			ancestor := path[i]
+			if isObsolete(ancestor) {
+				switch tree.obsoleteMode {
+				case obsoleteSkip:
+					log.Printf("Skipping obsolete parent subsystem \"%s\"\n", ancestor.Name.String)
+					continue
+				case obsoleteRemap:
+					ancestor = tree.subsystems[tree.successors[ancestor.ID.Int64]]
+				}
+			}
+			tags = append(tags, tree.prefixed(ancestor, ancestor.Name.String))
+		}
+		return tags
+	default:
+		return []string{tree.name(id)}
+	}
+}
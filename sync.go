@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// How sync works, from the command line
+type syncSettings struct {
+	interval       time.Duration
+	update         bool          // Carry edits over every pass
+	runMin, runMax string        // Run number bounds
+	runLimit       int           // Runs migrated per pass at most, the rest comes next pass
+	pendingFor     time.Duration // How long replies to comments that are not migrated are retried
+}
+
+func parseRunLimit(value string) int {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		panic(fmt.Sprintf("Invalid run limit \"%s\", expected a positive number", value))
+	}
+	return limit
+}
+
+/// Keeps Jiskefet up to date with the logbook while both are in use: every
+/// interval, migrates what was added to the logbook since the last pass.
+/// With update, edits to migrated comments are carried over every pass too.
+/// Stops after the current pass on SIGINT or SIGTERM. The ID map is saved
+/// after every pass, so a stopped sync can be picked up again later.
+func syncLogbook(args Args, source logbook.Source, target Target, idMapFile string, settings syncSettings) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	subsystems := newSubsystemTree(args, logbook.SubsystemsMap(source))
+	if preparer, ok := target.(tagPreparer); ok {
+		log.Printf("Preparing tags\n")
+		preparer.PrepareTags(getNeededTagTexts(args, source, subsystems))
+	}
+
+	for pass := 1; ; pass++ {
+		log.Printf("Sync pass %d, interrupt to stop after it\n", pass)
+		syncLogbookPass(args, source, target, subsystems, settings)
+		if settings.update {
+			updateLogbookComments(args, source, target, subsystems)
+		}
+		saveIDMap(args, target, idMapFile)
+
+		select {
+		case received := <-stop:
+			log.Printf("Received %s, sync stopped\n", received)
+			return
+		case <-time.After(settings.interval):
+		}
+	}
+}
+
+/// Migrates the users, runs, comments and attachments that are not in the
+/// ID map yet, and moves the watermarks past them. Runs and threads are
+/// selected with the same bounds and filters as the migration. Passes run one
+/// at a time, so the watermarks and pending comments are only touched here.
+func syncLogbookPass(args Args, source logbook.Source, target Target, subsystems *subsystemTree, settings syncSettings) {
+	ids := args.idMap
+
+	// Users first, so new comments have their authors
+	newUsers := make([]logbook.User, 0)
+	for _, user := range source.Users() {
+		if _, merged := args.userMerges[user.ID.Int64]; !merged && !ids.hasUser(user.ID.Int64) {
+			newUsers = append(newUsers, user)
+		}
+	}
+	if len(newUsers) > 0 {
+		check(warnNotSupported(upsertLogbookUsers(args, newUsers, target), "Syncing users"))
+	}
+
+	runs := 0
+	for _, run := range source.RunsUpdatedSince(ids.Watermarks.Runs, settings.runMin, settings.runMax) {
+		if !ids.hasRun(run.Run.String) {
+			if runs == settings.runLimit {
+				log.Printf("Migrated %d runs, the rest follows next pass\n", runs)
+				break
+			}
+			migrateLogbookRun(args, run, target)
+			runs++
+		}
+		ids.Watermarks.Runs = run.Time_update.String
+	}
+
+	syncLogbookComments(args, source, target, subsystems, settings.pendingFor)
+
+	// Attachments added to comments that were migrated in an earlier pass.
+	// Those of comments that are not migrated yet come with their comment.
+	for _, file := range source.FilesSince(ids.Watermarks.Files) {
+		ids.Watermarks.Files = file.TimeCreated.String
+		if ids.hasFile(file.FileID.Int64) {
+			continue
+		}
+		if jiskefetID, _, exists := ids.logIDs(file.CommentID.Int64); exists {
+			log.Printf("File \"%s\" added to comment %d\n", file.FileName.String, file.CommentID.Int64)
+			uploadAttachment(args, jiskefetID, file, target)
+		}
+	}
+}
+
+/// Migrates new threads that pass the filters, and replies to threads that
+/// are migrated. Replies to comments that are not migrated are kept pending,
+/// apart from the watermark, and retried every pass until pendingFor has
+/// passed. Replies to threads that were filtered out are skipped. The
+/// watermark only moves when the pass is done, a pass that fails part-way
+/// starts from the same comments again, and skips the ones it migrated.
+func syncLogbookComments(args Args, source logbook.Source, target Target, subsystems *subsystemTree, pendingFor time.Duration) {
+	ids := args.idMap
+
+	// Pending ones first, they are older
+	pendingIDs := make([]int64, 0, len(ids.Pending))
+	for logbookID := range ids.Pending {
+		pendingIDs = append(pendingIDs, logbookID)
+	}
+	sort.Slice(pendingIDs, func(i, j int) bool { return pendingIDs[i] < pendingIDs[j] })
+	comments := make([]logbook.Comment, 0)
+	for _, logbookID := range pendingIDs {
+		comments = append(comments, source.Comment(logbookID))
+	}
+	newComments := source.CommentsSince(ids.Watermarks.Comments)
+	for _, comment := range newComments {
+		if _, pending := ids.Pending[comment.ID.Int64]; !pending {
+			comments = append(comments, comment)
+		}
+	}
+
+	// Replies can come before their parent in the same pass, so keep going as
+	// long as that makes progress
+	skipped := make(map[int64]bool) // Filtered out in this pass, with their replies
+	pending := comments
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		remaining := pending[:0]
+		for _, comment := range pending {
+			logbookID := comment.ID.Int64
+			if _, _, migrated := ids.logIDs(logbookID); migrated {
+				delete(ids.Pending, logbookID)
+				continue
+			}
+			if !comment.Parent.Valid {
+				if args.filter != nil && !args.filter.matchesRoot(source, comment, subsystems) {
+					log.Printf("Thread %d filtered out\n", logbookID)
+					skipped[logbookID] = true
+					continue
+				}
+				migrateLogbookComment(args, source, target, subsystems, logbookID, 0, -1, -1)
+				progress = true
+			} else if skipped[comment.Parent.Int64] {
+				skipped[logbookID] = true
+				progress = true
+			} else if jiskefetParentID, jiskefetRootID, exists := ids.logIDs(comment.Parent.Int64); exists {
+				migrateLogbookComment(args, source, target, subsystems, logbookID, 1, jiskefetParentID, jiskefetRootID)
+				delete(ids.Pending, logbookID)
+				progress = true
+			} else {
+				remaining = append(remaining, comment)
+			}
+		}
+		pending = remaining
+	}
+
+	now := time.Now().UTC()
+	for _, comment := range pending {
+		logbookID := comment.ID.Int64
+		if args.filter != nil && comment.RootParent.Valid &&
+			!args.filter.matchesRoot(source, source.Comment(comment.RootParent.Int64), subsystems) {
+			log.Printf("Comment %d is in thread %d, which is filtered out\n", logbookID, comment.RootParent.Int64)
+			delete(ids.Pending, logbookID)
+			continue
+		}
+		since, exists := ids.Pending[logbookID]
+		if !exists {
+			since = now.Format(time.RFC3339)
+			ids.Pending[logbookID] = since
+		}
+		if started, err := time.Parse(time.RFC3339, since); err == nil && now.Sub(started) >= pendingFor {
+			log.Printf("WARNING: Comment %d replies to comment %d, which is still not migrated after %s, giving up\n",
+				logbookID, comment.Parent.Int64, pendingFor)
+			args.report.addOrphanedThread(logbookID, comment.Parent.Int64, "orphan", orphansQuarantine, []int64{logbookID})
+			delete(ids.Pending, logbookID)
+			continue
+		}
+		log.Printf("WARNING: Comment %d replies to comment %d, which is not migrated, retrying next pass\n",
+			logbookID, comment.Parent.Int64)
+	}
+
+	// Everything up to here is migrated, filtered out or pending
+	if len(newComments) > 0 {
+		ids.Watermarks.Comments = newComments[len(newComments)-1].TimeCreated.String
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	tagsclient "github.com/SoftwareForScience/jiskefet-api-go/client/tags"
+	"github.com/SoftwareForScience/jiskefet-api-go/models"
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+	"github.com/go-openapi/runtime"
+)
+
+/// Cache of tag text -> Jiskefet tag ID, shared by all workers.
+/// It's filled up front by prefetch and ensure, so during the migration
+/// lookups only need the read lock. Tags that are still missing are created
+/// one at a time, without blocking lookups of other tags.
+type tagCache struct {
+	mutex    sync.RWMutex // Guards ids and created
+	ids      map[string]int64
+	created  []string   // Tags created since the last takeCreated
+	creating sync.Mutex // Serialises GetTags/PostTags round trips for missing tags
+	client   *tagsclient.Client
+	auth     runtime.ClientAuthInfoWriter
+}
+
+/// On-disk format of the tag cache. IDs are only valid for the Jiskefet
+/// instance they came from, so the file records which one that was.
+type tagCacheFile struct {
+	Host string           `json:"host"`
+	Tags map[string]int64 `json:"tags"`
+}
+
+func newTagCache(client *tagsclient.Client, auth runtime.ClientAuthInfoWriter) *tagCache {
+	return &tagCache{
+		ids:    make(map[string]int64),
+		client: client,
+		auth:   auth,
+	}
+}
+
+/// Reads the tag IDs persisted by an earlier run, if the file exists and is
+/// for the same Jiskefet host. Returns whether it was loaded.
+func (cache *tagCache) load(path string, host string) bool {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("No tag cache at \"%s\" yet\n", path)
+		return false
+	}
+	check(err)
+	var file tagCacheFile
+	check(json.Unmarshal(data, &file))
+	if file.Host != host {
+		log.Printf("WARNING: Tag cache \"%s\" is for host \"%s\", not \"%s\", ignoring it\n", path, file.Host, host)
+		return false
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for tagText, tagID := range file.Tags {
+		cache.ids[tagText] = tagID
+	}
+	log.Printf("Loaded %d tags from cache \"%s\"\n", len(file.Tags), path)
+	return true
+}
+
+/// Removes tags that no longer exist in Jiskefet
+func (cache *tagCache) forget(tagTexts []string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, tagText := range tagTexts {
+		delete(cache.ids, tagText)
+	}
+}
+
+/// Persists the tag IDs for the next run
+func (cache *tagCache) save(path string, host string) {
+	cache.mutex.RLock()
+	count := len(cache.ids)
+	data, err := json.MarshalIndent(tagCacheFile{Host: host, Tags: cache.ids}, "", "  ")
+	cache.mutex.RUnlock()
+	check(err)
+	check(ioutil.WriteFile(path, data, 0644))
+	log.Printf("Saved %d tags to cache \"%s\"\n", count, path)
+}
+
+/// Tags per GetTags page when fetching all of them
+const tagPageSize = 100
+
+/// Fetches all tags that already exist in Jiskefet, page by page
+func (cache *tagCache) prefetch() {
+	fetched := 0
+	seen := make(map[int64]bool)
+	for page := int64(1); ; page++ {
+		params := tagsclient.NewGetTagsParams()
+		pageSize := int64(tagPageSize)
+		params.PageNumber = &page
+		params.PageSize = &pageSize
+		response, err := cache.client.GetTags(params, cache.auth)
+		check(err)
+		items, err := decodeTags("GetTags", response.Payload)
+		check(err)
+
+		added := 0
+		cache.mutex.Lock()
+		for _, item := range items {
+			if !seen[*item.TagID] {
+				seen[*item.TagID] = true
+				cache.ids[*item.TagText] = *item.TagID
+				added++
+			}
+		}
+		cache.mutex.Unlock()
+		fetched += added
+		// A short page is the last one, and a page with nothing new means
+		// paging is not supported and everything came at once
+		if len(items) < tagPageSize || added == 0 {
+			break
+		}
+	}
+	log.Printf("Fetched %d existing tags\n", fetched)
+}
+
+/// Makes sure all given tags exist in Jiskefet and are in the cache. Tags
+/// that fail are logged, and will fail again when linked.
+func (cache *tagCache) ensure(tagTexts []string) {
+	for _, tagText := range tagTexts {
+		if _, err := cache.id(tagText); err != nil {
+			log.Printf("WARNING: Could not prepare tag \"%s\": %s\n", tagText, err)
+		}
+	}
+}
+
+func (cache *tagCache) lookup(tagText string) (int64, bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	tagID, exists := cache.ids[tagText]
+	return tagID, exists
+}
+
+/// Returns the ID of the tag, creating it in Jiskefet if necessary
+func (cache *tagCache) id(tagText string) (int64, error) {
+	if tagID, exists := cache.lookup(tagText); exists {
+		return tagID, nil
+	}
+
+	cache.creating.Lock()
+	defer cache.creating.Unlock()
+	// Another worker may have created it while we were waiting
+	if tagID, exists := cache.lookup(tagText); exists {
+		return tagID, nil
+	}
+
+	// Check if tag exists in Jiskefet
+	var tagID int64
+	params := tagsclient.NewGetTagsParams()
+	params.TagText = &tagText
+	response, err := cache.client.GetTags(params, cache.auth)
+	if err != nil {
+		return 0, fmt.Errorf("looking up tag: %s", err)
+	}
+	items, err := decodeTags("GetTags", response.Payload)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) > 0 {
+		// Tag exists, add ID to cache
+		tagID = *items[0].TagID
+	} else {
+		// If not, add tag to Jiskefet and ID to cache
+		params := tagsclient.NewPostTagsParams()
+		params.CreateTagDto = new(models.CreateTagDto)
+		params.CreateTagDto.TagText = &tagText
+		response, err := cache.client.PostTags(params, cache.auth)
+		if err != nil {
+			return 0, fmt.Errorf("creating tag: %s", err)
+		}
+		item, err := decodeTag("PostTags", response.Payload)
+		if err != nil {
+			return 0, err
+		}
+		tagID = *item.TagID
+		log.Printf("Tag %s did not exist, added to Jiskefet with ID=%d", tagText, tagID)
+	}
+
+	cache.mutex.Lock()
+	cache.ids[tagText] = tagID
+	if len(items) == 0 { // Created above
+		cache.created = append(cache.created, tagText)
+	}
+	cache.mutex.Unlock()
+	return tagID, nil
+}
+
+/// Returns the tags created since the last call
+func (cache *tagCache) takeCreated() []string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	created := cache.created
+	cache.created = nil
+	return created
+}
+
+/// Returns every tag text the comment migration can link: all comment types,
+/// classes and contexts in use, all subsystems and the batch
+func getNeededTagTexts(args Args, source logbook.Source, subsystems *subsystemTree) []string {
+	tagTexts := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, kind := range source.CommentKinds() {
+		values := map[string]string{
+			tagCategoryCommentType: kind.CommentType.String,
+			tagCategoryClass:       kind.Class.String,
+			tagCategoryContext:     kind.Context.String,
+		}
+		for category, value := range values {
+			if key := category + "/" + value; !seen[key] {
+				seen[key] = true
+				tagTexts = append(tagTexts, args.tagRules.tagTexts(category, value)...)
+			}
+		}
+	}
+
+	for id := range subsystems.subsystems {
+		for _, subsystemTagText := range subsystems.tagTexts(id) {
+			tagTexts = append(tagTexts, args.tagRules.tagTexts(tagCategorySubsystem, subsystemTagText)...)
+		}
+	}
+
+	tagTexts = append(tagTexts, batchTagText(args.batchID))
+
+	tagTexts = uniqueTagTexts(tagTexts)
+	sort.Strings(tagTexts)
+	return tagTexts
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Logbook values that can become tags
+const (
+	tagCategoryCommentType = "commentType" // Comment.CommentType, e.g. "HARDWARE"
+	tagCategorySubsystem   = "subsystem"   // Subsystem tag texts, after -subsystemtags and -obsoletesubsystems
+	tagCategoryClass       = "class"       // Comment.Class, e.g. "HUMAN"
+	tagCategoryContext     = "context"     // Comment.Context, e.g. "QUALITYFLAG"
+)
+
+var tagCategories = []string{tagCategoryCommentType, tagCategorySubsystem, tagCategoryClass, tagCategoryContext}
+
+// What Jiskefet's tags.tag_text column and tag API accept, unless the rules say otherwise
+const (
+	defaultMaxTagLength = 255
+	defaultTagPattern   = `^[A-Za-z0-9 _\-./:+()]+$`
+)
+
+/// Rules for turning logbook values into Jiskefet tag texts, read from a JSON
+/// file. Example file:
+///   {
+///     "formats": {"commentType": "TYPE/%s", "context": "CONTEXT/%s"},
+///     "mappings": {
+///       "commentType": {"DQM/QA": ["DQM", "QA"], "OTHER": []},
+///       "subsystem": {"SPD_OLD": ["SPD"]}
+///     },
+///     "maxLength": 64,
+///     "pattern": "^[A-Za-z0-9 _./-]+$"
+///   }
+/// A mapping to no tags drops the value, to several tags splits it, and
+/// mapping several values to the same tag merges them. Values without a
+/// mapping get the format of their category, where an empty format means the
+/// category is not tagged. Tags longer than maxLength, or not matching
+/// pattern, are left out. Without them the file gets Jiskefet's own limits.
+type TagRules struct {
+	Formats   map[string]string              `json:"formats"`
+	Mappings  map[string]map[string][]string `json:"mappings"`
+	MaxLength int                            `json:"maxLength"`
+	Pattern   string                         `json:"pattern"` // Regular expression for allowed tags
+	pattern   *regexp.Regexp
+}
+
+func defaultTagRules() *TagRules {
+	return &TagRules{
+		Formats: map[string]string{
+			tagCategoryCommentType: "COMMENT_TYPE/%s",
+			tagCategorySubsystem:   "%s",
+			tagCategoryClass:       "",
+			tagCategoryContext:     "",
+		},
+		Mappings:  make(map[string]map[string][]string),
+		MaxLength: defaultMaxTagLength,
+		Pattern:   defaultTagPattern,
+		pattern:   regexp.MustCompile(defaultTagPattern),
+	}
+}
+
+/// Reads the tag rules from the file, on top of the defaults, and validates
+/// them. With an empty path, returns the defaults.
+func loadTagRules(path string) *TagRules {
+	rules := defaultTagRules()
+	if path == "" {
+		return rules
+	}
+
+	data, err := ioutil.ReadFile(path)
+	check(err)
+	var fileRules TagRules
+	check(json.Unmarshal(data, &fileRules))
+	for category, format := range fileRules.Formats {
+		rules.Formats[category] = format
+	}
+	for category, mapping := range fileRules.Mappings {
+		rules.Mappings[category] = mapping
+	}
+	if fileRules.MaxLength > 0 {
+		rules.MaxLength = fileRules.MaxLength
+	}
+	if fileRules.Pattern != "" {
+		rules.Pattern = fileRules.Pattern
+	}
+
+	if errs := rules.validate(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Tag rules: %s\n", err)
+		}
+		panic(fmt.Sprintf("Invalid tag rules in \"%s\"", path))
+	}
+	return rules
+}
+
+func (rules *TagRules) validate() []error {
+	errs := make([]error, 0)
+	pattern, err := regexp.Compile(rules.Pattern)
+	if err != nil {
+		// Without it the mapped tags can't be checked
+		return append(errs, fmt.Errorf("invalid pattern: %s", err))
+	}
+	rules.pattern = pattern
+	known := make(map[string]bool)
+	for _, category := range tagCategories {
+		known[category] = true
+	}
+
+	for category, format := range rules.Formats {
+		if !known[category] {
+			errs = append(errs, fmt.Errorf("unknown category \"%s\" in formats", category))
+		}
+		if format != "" && strings.Count(format, "%s") != 1 {
+			errs = append(errs, fmt.Errorf("format \"%s\" of %s must contain %%s exactly once", format, category))
+		}
+	}
+	for category, mapping := range rules.Mappings {
+		if !known[category] {
+			errs = append(errs, fmt.Errorf("unknown category \"%s\" in mappings", category))
+		}
+		for value, tagTexts := range mapping {
+			for _, tagText := range tagTexts {
+				if err := rules.checkTagText(tagText); err != nil {
+					errs = append(errs, fmt.Errorf("%s \"%s\": %s", category, value, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+/// Checks that a tag text is not empty, and against the length and pattern
+func (rules *TagRules) checkTagText(tagText string) error {
+	if tagText == "" {
+		return fmt.Errorf("tag is empty")
+	}
+	if len(tagText) > rules.MaxLength {
+		return fmt.Errorf("tag \"%s\" is longer than %d characters", tagText, rules.MaxLength)
+	}
+	if !rules.pattern.MatchString(tagText) {
+		return fmt.Errorf("tag \"%s\" doesn't match pattern %s", tagText, rules.Pattern)
+	}
+	return nil
+}
+
+/// Returns the tag texts for a logbook value of the given category. Tags that
+/// don't pass validation are logged and left out.
+func (rules *TagRules) tagTexts(category string, value string) []string {
+	if value == "" {
+		return nil
+	}
+	tagTexts, mapped := rules.Mappings[category][value]
+	if !mapped {
+		format := rules.Formats[category]
+		if format == "" {
+			return nil
+		}
+		tagTexts = []string{fmt.Sprintf(format, value)}
+	}
+
+	valid := make([]string, 0, len(tagTexts))
+	for _, tagText := range tagTexts {
+		if err := rules.checkTagText(tagText); err != nil {
+			log.Printf("WARNING: Not linking %s \"%s\": %s\n", category, value, err)
+			continue
+		}
+		valid = append(valid, tagText)
+	}
+	return valid
+}
+
+/// Removes duplicate tag texts, keeping the first occurrence
+func uniqueTagTexts(tagTexts []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(tagTexts))
+	for _, tagText := range tagTexts {
+		if !seen[tagText] {
+			seen[tagText] = true
+			unique = append(unique, tagText)
+		}
+	}
+	return unique
+}
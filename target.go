@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// The migration writes through a Target, so it can migrate into environments
+// where one of the channels to Jiskefet is unavailable
+const (
+	targetJiskefet = "jiskefet" // REST API, with direct DB access for what the API can't do
+	targetAPI      = "api"      // REST API only
+	targetDB       = "db"       // Direct Jiskefet DB writes only
+	targetFile     = "file"     // JSON-lines file
+)
+
+var errNotSupported = errors.New("not supported by this target")
+
+/// A log or a comment to create. Comments also have a parent and root.
+type TargetLog struct {
+	LogbookID int64  `json:"logbookId"` // ID of the comment in the logbook
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Origin    string `json:"origin"`  // "human" or "process"
+	Subtype   string `json:"subtype"` // "run", "comment", ...
+	UserID    int64  `json:"userId"`
+	ParentID  int64  `json:"parentId,omitempty"` // Comments only
+	RootID    int64  `json:"rootId,omitempty"`   // Comments only
+}
+
+/// A run to create
+type TargetRun struct {
+	RunNumber  string `json:"runNumber"` // Run number in the logbook
+	NDetectors int64  `json:"nDetectors"`
+	NFlps      int64  `json:"nFlps"`
+	NEpns      int64  `json:"nEpns"`
+}
+
+/// An attachment to add to a log
+type TargetAttachment struct {
+	FileName    string `json:"fileName"`
+	Title       string `json:"title"`
+	Mime        string `json:"mime"`
+	Data        []byte `json:"data"`
+	TimeCreated string `json:"timeCreated"` // Logbook timestamp
+}
+
+/// A user to insert. Jiskefet only keeps the IDs of users, their names and
+/// emails come from the login.
+type TargetUser struct {
+	ID int64 `json:"id"`
+}
+
+/// A subsystem to insert
+type TargetSubsystem struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+/// Where migrated data is written to
+type Target interface {
+	CreateLog(entry TargetLog) (int64, error)     // Returns the ID of the new log
+	CreateComment(entry TargetLog) (int64, error) // Returns the ID of the new comment
+	CreateRun(run TargetRun) (int64, error)       // Returns the new run number
+	// Returns the ID of the new attachment, or 0 if the target skipped it
+	AttachFile(logID int64, attachment TargetAttachment) (int64, error)
+	LinkTag(logID int64, tagText string) error
+	UnlinkTag(logID int64, tagText string) error
+	UpdateLog(logID int64, title string, body string) error
+	// Inserts the users, all or nothing. Users that exist already with other data are handled by onConflict,
+	// see conflictKeep etc. Returns what was done with each user.
+	UpsertUsers(users []TargetUser, onConflict string) ([]UpsertResult, error)
+	// Inserts the subsystems, all or nothing, like UpsertUsers
+	UpsertSubsystems(subsystems []TargetSubsystem, onConflict string) ([]UpsertResult, error)
+	SetCreationTime(logID int64, timeCreated string) error
+	Close() error
+}
+
+/// Implemented by targets that benefit from knowing all tags that will be
+/// linked before the migration starts
+type tagPreparer interface {
+	PrepareTags(tagTexts []string)
+}
+
+/// Implemented by targets that buffer writes
+type targetFlusher interface {
+	Flush() error // Writes everything that is buffered
+}
+
+/// Implemented by targets that create missing tags, so a rollback can remove
+/// the tags a migration created
+type tagCreator interface {
+	CreatedTags() []string // Returns the tags created since the last call
+}
+
+/// Opens the target of the given kind. Database targets need the Jiskefet DB.
+func openTarget(args Args, kind string, jiskefetDB *sql.DB) Target {
+	switch kind {
+	case targetJiskefet:
+		return &jiskefetTarget{apiTarget: newAPITarget(args), db: newDBTarget(jiskefetDB)}
+	case targetAPI:
+		return newAPITarget(args)
+	case targetDB:
+		return newDBTarget(jiskefetDB)
+	case targetFile:
+		return newFileTarget(args.targetFile)
+	}
+	panic(fmt.Sprintf("Unknown target \"%s\", expected %s, %s, %s or %s",
+		kind, targetJiskefet, targetAPI, targetDB, targetFile))
+}
+
+/// The REST API, falling back to direct DB writes for users, subsystems,
+/// creation times, updates and batches, which the API doesn't support
+type jiskefetTarget struct {
+	*apiTarget
+	db *dbTarget
+}
+
+func (target *jiskefetTarget) UpsertUsers(users []TargetUser, onConflict string) ([]UpsertResult, error) {
+	return target.db.UpsertUsers(users, onConflict)
+}
+
+func (target *jiskefetTarget) UpsertSubsystems(subsystems []TargetSubsystem, onConflict string) ([]UpsertResult, error) {
+	return target.db.UpsertSubsystems(subsystems, onConflict)
+}
+
+func (target *jiskefetTarget) SetCreationTime(logID int64, timeCreated string) error {
+	return target.db.SetCreationTime(logID, timeCreated)
+}
+
+/// Updates through the API if it can, otherwise directly in the DB
+func (target *jiskefetTarget) UpdateLog(logID int64, title string, body string) error {
+	if err := target.apiTarget.UpdateLog(logID, title, body); err != errNotSupported {
+		return err
+	}
+	return target.db.UpdateLog(logID, title, body)
+}
+
+func (target *jiskefetTarget) UnlinkTag(logID int64, tagText string) error {
+	if err := target.apiTarget.UnlinkTag(logID, tagText); err != errNotSupported {
+		return err
+	}
+	return target.db.UnlinkTag(logID, tagText)
+}
+
+func (target *jiskefetTarget) Flush() error {
+	return target.db.Flush()
+}
+
+func (target *jiskefetTarget) StartBatch(batch batchInfo) error {
+	return target.db.StartBatch(batch)
+}
+
+func (target *jiskefetTarget) FinishBatch(batch batchInfo) error {
+	return target.db.FinishBatch(batch)
+}
+
+/// Closes both parts, also when one of them fails, so the buffered creation
+/// times are always written
+func (target *jiskefetTarget) Close() error {
+	dbErr := target.db.Close()
+	apiErr := target.apiTarget.Close()
+	if apiErr == nil {
+		return dbErr
+	}
+	if dbErr == nil {
+		return apiErr
+	}
+	return fmt.Errorf("closing the API target: %s; closing the DB target: %s", apiErr, dbErr)
+}
+
+/// Logs and ignores operations the target doesn't support, for stages that
+/// can do without them
+func warnNotSupported(err error, what string) error {
+	if err == errNotSupported {
+		log.Printf("WARNING: %s %s\n", what, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	logsclient "github.com/SoftwareForScience/jiskefet-api-go/client/logs"
+	runsclient "github.com/SoftwareForScience/jiskefet-api-go/client/runs"
+	tagsclient "github.com/SoftwareForScience/jiskefet-api-go/client/tags"
+	"github.com/SoftwareForScience/jiskefet-api-go/models"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/strfmt"
+)
+
+/// Writes to Jiskefet through the REST API
+type apiTarget struct {
+	logsClient   *logsclient.Client
+	tagsClient   *tagsclient.Client
+	runsClient   *runsclient.Client
+	auth         runtime.ClientAuthInfoWriter
+	tagIDCache   *tagCache
+	tagCacheFile string // Where tag IDs are persisted between runs, empty to not persist
+	host         string
+	strictTags   bool // Verify every tag link by getting the log back
+}
+
+func newAPITarget(args Args) *apiTarget {
+	target := &apiTarget{
+		logsClient:   logsclient.New(args.runtime, strfmt.Default),
+		tagsClient:   tagsclient.New(args.runtime, strfmt.Default),
+		runsClient:   runsclient.New(args.runtime, strfmt.Default),
+		auth:         args.bearerToken,
+		tagCacheFile: args.tagCacheFile,
+		host:         args.jiskefetHost,
+		strictTags:   args.strictTags,
+	}
+	target.tagIDCache = newTagCache(target.tagsClient, target.auth) // Cache of tag text -> tag ID
+	if target.tagCacheFile != "" {
+		target.tagIDCache.load(target.tagCacheFile, target.host)
+	}
+	return target
+}
+
+/// Classifies the error of an API call. The generated client reports any
+/// status code that's not in the API spec as an error, even when it's a
+/// success code, so those are not treated as errors here.
+func checkAPIResponse(err error) error {
+	if apiErr, ok := err.(*runtime.APIError); ok {
+		switch apiErr.Code {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			return nil
+		}
+	}
+	return err
+}
+
+func (target *apiTarget) CreateLog(entry TargetLog) (int64, error) {
+	params := logsclient.NewPostLogsParams()
+	params.CreateLogDto = new(models.CreateLogDto)
+	params.CreateLogDto.Attachments = make([]string, 0)
+	params.CreateLogDto.Body = &entry.Body
+	params.CreateLogDto.Origin = &entry.Origin
+	params.CreateLogDto.Subtype = &entry.Subtype
+	params.CreateLogDto.Title = &entry.Title
+	params.CreateLogDto.User = &entry.UserID
+	response, err := target.logsClient.PostLogs(params, target.auth)
+	if err != nil {
+		return 0, err
+	}
+	return decodeLogID("PostLogs", response.Payload)
+}
+
+func (target *apiTarget) CreateComment(entry TargetLog) (int64, error) {
+	params := logsclient.NewPostLogsThreadsParams()
+	params.CreateCommentDto = new(models.CreateCommentDto)
+	params.CreateCommentDto.Attachments = make([]string, 0)
+	params.CreateCommentDto.Body = &entry.Body
+	params.CreateCommentDto.Origin = &entry.Origin
+	params.CreateCommentDto.ParentID = &entry.ParentID
+	params.CreateCommentDto.RootID = &entry.RootID
+	params.CreateCommentDto.Subtype = &entry.Subtype
+	params.CreateCommentDto.Title = &entry.Title
+	params.CreateCommentDto.User = &entry.UserID
+	response, err := target.logsClient.PostLogsThreads(params, target.auth)
+	if err != nil {
+		return 0, err
+	}
+	return decodeLogID("PostLogsThreads", response.Payload)
+}
+
+func (target *apiTarget) CreateRun(run TargetRun) (int64, error) {
+	// The API doesn't take logbook run times yet, so use a placeholder
+	startt, err := time.Parse(time.RFC3339, "2001-01-01T11:11:11Z")
+	check(err)
+	start := strfmt.DateTime(startt)
+	runType := "my-run-type"
+	// activityId := "migrate"
+
+	params := runsclient.NewPostRunsParams()
+	params.CreateRunDto = new(models.CreateRunDto)
+	params.CreateRunDto.O2StartTime = &start
+	params.CreateRunDto.TrgStartTime = &start
+	params.CreateRunDto.RunType = &runType
+	// params.CreateRunDto.ActivityID = &activityId
+	params.CreateRunDto.NDetectors = &run.NDetectors
+	params.CreateRunDto.NFlps = &run.NFlps
+	params.CreateRunDto.NEpns = &run.NEpns
+
+	response, err := target.runsClient.PostRuns(params, target.auth)
+	if err != nil {
+		return 0, err
+	}
+	return decodeRunNumber("PostRuns", response.Payload)
+}
+
+func (target *apiTarget) AttachFile(logID int64, attachment TargetAttachment) (int64, error) {
+	if attachment.Mime == "image/jpeg" {
+		log.Printf("WARNING: Skipping jpeg image due to server bug\n")
+		return 0, nil
+	}
+	if len(attachment.Data) >= 8000 {
+		log.Printf("WARNING: Skipping large file (8kB+) due to server bug\n")
+		return 0, nil
+	}
+
+	fileEncoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	creationTimeT, err := time.Parse(time.RFC3339, "2001-01-01T11:11:11Z")
+	check(err)
+	creationTime := strfmt.DateTime(creationTimeT)
+
+	params := logsclient.NewPostLogsIDAttachmentsParams()
+	params.CreateAttachmentDto = new(models.CreateAttachmentDto)
+	params.CreateAttachmentDto.CreationTime = &creationTime
+	params.CreateAttachmentDto.FileData = &fileEncoded
+	params.CreateAttachmentDto.FileMime = &attachment.Mime
+	params.CreateAttachmentDto.FileName = &attachment.FileName
+	params.CreateAttachmentDto.Title = attachment.Title
+	params.ID = logID
+	response, err := target.logsClient.PostLogsIDAttachments(params, target.auth)
+	if err != nil {
+		return 0, err
+	}
+	fileID, err := decodeAttachmentID("PostLogsIDAttachments", response.Payload)
+	if err != nil {
+		// The attachment is there, we just don't know its ID
+		log.Printf("WARNING: %s\n", err)
+		return 0, nil
+	}
+	return fileID, nil
+}
+
+/// Fetches all existing tags and creates the missing ones up front, so the
+/// workers don't have to wait on each other for tag lookups
+func (target *apiTarget) PrepareTags(tagTexts []string) {
+	target.tagIDCache.prefetch()
+	target.tagIDCache.ensure(tagTexts)
+}
+
+func (target *apiTarget) CreatedTags() []string {
+	return target.tagIDCache.takeCreated()
+}
+
+func (target *apiTarget) LinkTag(logID int64, tagText string) error {
+	tagID, err := target.tagIDCache.id(tagText)
+	if err != nil {
+		return err
+	}
+
+	// Add it to the log
+	params := tagsclient.NewPatchTagsIDLogsParams()
+	params.ID = tagID
+	params.LinkLogToTagDto = new(models.LinkLogToTagDto)
+	params.LinkLogToTagDto.LogID = &logID
+	_, err = target.tagsClient.PatchTagsIDLogs(params, target.auth)
+	if err = checkAPIResponse(err); err != nil {
+		return fmt.Errorf("linking tag %d: %s", tagID, err)
+	}
+
+	if target.strictTags {
+		return target.verifyTagLinked(logID, tagID)
+	}
+	return nil
+}
+
+/// Checks that the log has the tag, by getting the log back from Jiskefet
+func (target *apiTarget) verifyTagLinked(logID int64, tagID int64) error {
+	params := logsclient.NewGetLogsIDParams()
+	params.ID = logID
+	response, err := target.logsClient.GetLogsID(params, target.auth)
+	if err != nil {
+		return fmt.Errorf("verifying tag link: %s", err)
+	}
+	item, err := decodeLog("GetLogsID", response.Payload)
+	if err != nil {
+		return fmt.Errorf("verifying tag link: %s", err)
+	}
+	if item.Tags == nil {
+		return fmt.Errorf("verifying tag link: log %d has no tags in response", logID)
+	}
+	for _, tag := range item.Tags {
+		if tag.TagID != nil && *tag.TagID == tagID {
+			return nil
+		}
+	}
+	return fmt.Errorf("verifying tag link: log %d does not have tag %d after linking", logID, tagID)
+}
+
+/// The API has no way to change or unlink tags from a log yet
+func (target *apiTarget) UnlinkTag(logID int64, tagText string) error {
+	return errNotSupported
+}
+
+/// The API has no way to edit a log yet
+func (target *apiTarget) UpdateLog(logID int64, title string, body string) error {
+	return errNotSupported
+}
+
+func (target *apiTarget) UpsertUsers(users []TargetUser, onConflict string) ([]UpsertResult, error) {
+	return nil, errNotSupported
+}
+
+func (target *apiTarget) UpsertSubsystems(subsystems []TargetSubsystem, onConflict string) ([]UpsertResult, error) {
+	return nil, errNotSupported
+}
+
+func (target *apiTarget) SetCreationTime(logID int64, timeCreated string) error {
+	return errNotSupported
+}
+
+func (target *apiTarget) Close() error {
+	if target.tagCacheFile != "" {
+		target.tagIDCache.save(target.tagCacheFile, target.host)
+	}
+	return nil
+}
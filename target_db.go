@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+/// Writes directly to the Jiskefet database, for what the API can't do, or
+/// when the API is unavailable. Tables and columns follow the Jiskefet schema.
+type dbTarget struct {
+	db              *sql.DB
+	withDescription bool // Whether sub_system has a description column
+	tagMutex        sync.Mutex
+	tagIDs          map[string]int64 // Cache of tag text -> tag ID
+	createdTags     []string         // Tags created since the last CreatedTags
+	creationMutex   sync.Mutex
+	creationTimes   []creationTime // Not written yet
+}
+
+type creationTime struct {
+	logID       int64
+	timeCreated string
+}
+
+func newDBTarget(jiskefetDB *sql.DB) *dbTarget {
+	target := &dbTarget{
+		db:     jiskefetDB,
+		tagIDs: make(map[string]int64),
+	}
+	// Not every Jiskefet version has a place for the subsystem description
+	target.withDescription = jiskefetColumnExists(jiskefetDB, "sub_system", "subsystem_description")
+	if !target.withDescription {
+		log.Printf("WARNING: Jiskefet has no subsystem description column, descriptions are not migrated\n")
+	}
+	return target
+}
+
+/// Checks if the Jiskefet DB has the given column, for features that depend
+/// on the Jiskefet version
+func jiskefetColumnExists(jiskefetDB *sql.DB, table string, column string) bool {
+	var count int
+	err := jiskefetDB.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column).Scan(&count)
+	check(err)
+	return count > 0
+}
+
+func (target *dbTarget) insert(query string, values ...interface{}) (int64, error) {
+	res, err := target.db.Exec(query, values...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (target *dbTarget) CreateLog(entry TargetLog) (int64, error) {
+	return target.insert("INSERT INTO log(subtype, origin, title, body, fk_user_id) VALUES(?,?,?,?,?)",
+		entry.Subtype, entry.Origin, entry.Title, entry.Body, entry.UserID)
+}
+
+func (target *dbTarget) CreateComment(entry TargetLog) (int64, error) {
+	return target.insert("INSERT INTO log(subtype, origin, title, body, fk_user_id, fk_parent_log_id, fk_root_log_id) "+
+		"VALUES(?,?,?,?,?,?,?)",
+		entry.Subtype, entry.Origin, entry.Title, entry.Body, entry.UserID, entry.ParentID, entry.RootID)
+}
+
+func (target *dbTarget) CreateRun(run TargetRun) (int64, error) {
+	// Unlike the API, the DB lets us keep the logbook run number
+	_, err := target.insert("INSERT INTO run(run_number, n_detectors, n_flps, n_epns) VALUES(?,?,?,?)",
+		run.RunNumber, run.NDetectors, run.NFlps, run.NEpns)
+	if err != nil {
+		return 0, err
+	}
+	var runNumber int64
+	err = target.db.QueryRow("SELECT run_number FROM run WHERE run_number = ?", run.RunNumber).Scan(&runNumber)
+	return runNumber, err
+}
+
+/// Stores the data base64 encoded, as Jiskefet stores what the API target sends
+func (target *dbTarget) AttachFile(logID int64, attachment TargetAttachment) (int64, error) {
+	return target.insert("INSERT INTO attachment(fk_log_id, title, file_name, file_mime, file_data, file_size, creation_time) "+
+		"VALUES(?,?,?,?,?,?,?)",
+		logID, attachment.Title, attachment.FileName, attachment.Mime, base64.StdEncoding.EncodeToString(attachment.Data),
+		len(attachment.Data), attachment.TimeCreated)
+}
+
+/// Returns the ID of the tag, creating it if necessary
+func (target *dbTarget) tagID(tagText string) (int64, error) {
+	target.tagMutex.Lock()
+	defer target.tagMutex.Unlock()
+	if tagID, exists := target.tagIDs[tagText]; exists {
+		return tagID, nil
+	}
+
+	var tagID int64
+	err := target.db.QueryRow("SELECT tag_id FROM tags WHERE tag_text = ?", tagText).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		tagID, err = target.insert("INSERT INTO tags(tag_text) VALUES(?)", tagText)
+		if err == nil {
+			log.Printf("Tag %s did not exist, added to Jiskefet with ID=%d", tagText, tagID)
+			target.createdTags = append(target.createdTags, tagText)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	target.tagIDs[tagText] = tagID
+	return tagID, nil
+}
+
+func (target *dbTarget) CreatedTags() []string {
+	target.tagMutex.Lock()
+	defer target.tagMutex.Unlock()
+	created := target.createdTags
+	target.createdTags = nil
+	return created
+}
+
+func (target *dbTarget) LinkTag(logID int64, tagText string) error {
+	tagID, err := target.tagID(tagText)
+	if err != nil {
+		return err
+	}
+	_, err = target.db.Exec("INSERT IGNORE INTO tags_logs(fk_tag_id, fk_log_id) VALUES(?,?)", tagID, logID)
+	return err
+}
+
+func (target *dbTarget) UnlinkTag(logID int64, tagText string) error {
+	_, err := target.db.Exec("DELETE tags_logs FROM tags_logs JOIN tags ON tags.tag_id = tags_logs.fk_tag_id "+
+		"WHERE tags.tag_text = ? AND tags_logs.fk_log_id = ?", tagText, logID)
+	return err
+}
+
+func (target *dbTarget) UpdateLog(logID int64, title string, body string) error {
+	_, err := target.db.Exec("UPDATE log SET title=?, body=? WHERE log_id=?", title, body, logID)
+	return err
+}
+
+/// Rows per multi-row statement, and creation times buffered before they are written
+const dbChunkSize = 200
+
+/// Runs fn in a transaction, which is rolled back as a whole if fn fails
+func (target *dbTarget) inTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := target.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("WARNING: Rolling back failed: %s\n", rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+/// Returns "(?,...)" with count placeholders
+func placeholders(count int) string {
+	return "(?" + strings.Repeat(",?", count-1) + ")"
+}
+
+/// A *sql.DB or *sql.Tx
+type dbQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+/// Returns the rows that are in the table already, by ID, with their columns
+/// as text. The first column is the ID.
+func existingRows(db dbQueryer, table string, columns []string, ids []int64) (map[int64][]string, error) {
+	existing := make(map[int64][]string)
+	for start := 0; start < len(ids); start += dbChunkSize {
+		end := start + dbChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		values := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			values = append(values, id)
+		}
+		rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s IN %s",
+			strings.Join(columns, ", "), table, columns[0], placeholders(len(values))), values...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			row := make([]sql.NullString, len(columns)-1)
+			dest := []interface{}{&id}
+			for i := range row {
+				dest = append(dest, &row[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			texts := make([]string, len(row))
+			for i, value := range row {
+				texts[i] = value.String // NULL is the same as empty
+			}
+			existing[id] = texts
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+/// Inserts the rows with multi-row inserts of up to dbChunkSize rows. Full
+/// chunks share one prepared statement, only the last one gets its own.
+func insertRows(tx *sql.Tx, insertQuery string, rows [][]interface{}) error {
+	var fullChunk *sql.Stmt
+	defer func() {
+		if fullChunk != nil {
+			fullChunk.Close()
+		}
+	}()
+	for start := 0; start < len(rows); start += dbChunkSize {
+		end := start + dbChunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		rowPlaceholders := make([]string, 0, end-start)
+		values := make([]interface{}, 0)
+		for _, row := range rows[start:end] {
+			rowPlaceholders = append(rowPlaceholders, placeholders(len(row)))
+			values = append(values, row...)
+		}
+		query := insertQuery + " VALUES" + strings.Join(rowPlaceholders, ",")
+
+		var err error
+		if end-start < dbChunkSize {
+			_, err = tx.Exec(query, values...)
+		} else {
+			if fullChunk == nil {
+				if fullChunk, err = tx.Prepare(query); err != nil {
+					return err
+				}
+			}
+			_, err = fullChunk.Exec(values...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/// Inserts the rows that are not in the table yet, and compares the others
+/// with what is there, all or nothing. The first column is the ID. Rows with
+/// other data are handled by onConflict, see conflictKeep etc.
+func (target *dbTarget) upsertRows(kind string, table string, columns []string, rows [][]interface{},
+	onConflict string) ([]UpsertResult, error) {
+	results := make([]UpsertResult, len(rows))
+	err := target.inTransaction(func(tx *sql.Tx) error {
+		ids := make([]int64, len(rows))
+		for i, row := range rows {
+			ids[i] = row[0].(int64)
+		}
+		existing, err := existingRows(tx, table, columns, ids)
+		if err != nil {
+			return err
+		}
+
+		var update *sql.Stmt
+		defer func() {
+			if update != nil {
+				update.Close()
+			}
+		}()
+		missing := make([][]interface{}, 0)
+		for i, row := range rows {
+			existingRow, exists := existing[ids[i]]
+			if !exists {
+				results[i] = UpsertResult{Outcome: upsertInserted}
+				missing = append(missing, row)
+				continue
+			}
+			differences := make([]FieldDifference, 0)
+			for c, value := range row[1:] {
+				if incoming := fmt.Sprint(value); incoming != existingRow[c] {
+					differences = append(differences,
+						FieldDifference{Field: columns[c+1], Existing: existingRow[c], Incoming: incoming})
+				}
+			}
+			if len(differences) == 0 {
+				results[i] = UpsertResult{Outcome: upsertDuplicate}
+				continue
+			}
+
+			switch onConflict {
+			case conflictKeep:
+				results[i] = UpsertResult{Outcome: upsertKept, Differences: differences}
+			case conflictOverwrite:
+				if update == nil {
+					update, err = tx.Prepare(fmt.Sprintf("UPDATE %s SET %s=? WHERE %s=?",
+						table, strings.Join(columns[1:], "=?, "), columns[0]))
+					if err != nil {
+						return err
+					}
+				}
+				values := append(append([]interface{}{}, row[1:]...), ids[i])
+				if _, err := update.Exec(values...); err != nil {
+					return err
+				}
+				results[i] = UpsertResult{Outcome: upsertOverwritten, Differences: differences}
+			default:
+				return &upsertConflictError{Kind: kind, ID: ids[i], Differences: differences}
+			}
+		}
+		// No IGNORE, anything that goes wrong is an error
+		return insertRows(tx, fmt.Sprintf("INSERT INTO %s(%s)", table, strings.Join(columns, ", ")), missing)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+/// The logbook user ID is also the external and SAMS ID. A user with the ID
+/// and other external or SAMS IDs is someone else, e.g. who logged in already.
+func (target *dbTarget) UpsertUsers(users []TargetUser, onConflict string) ([]UpsertResult, error) {
+	rows := make([][]interface{}, 0, len(users))
+	for _, user := range users {
+		rows = append(rows, []interface{}{user.ID, user.ID, user.ID})
+	}
+	return target.upsertRows("user", "user", []string{"user_id", "external_id", "sams_id"}, rows, onConflict)
+}
+
+func (target *dbTarget) UpsertSubsystems(subsystems []TargetSubsystem, onConflict string) ([]UpsertResult, error) {
+	columns := []string{"subsystem_id", "subsystem_name"}
+	if target.withDescription {
+		columns = append(columns, "subsystem_description")
+	}
+	rows := make([][]interface{}, 0, len(subsystems))
+	for _, subsystem := range subsystems {
+		row := []interface{}{subsystem.ID, subsystem.Name}
+		if target.withDescription {
+			row = append(row, subsystem.Description)
+		}
+		rows = append(rows, row)
+	}
+	return target.upsertRows("subsystem", "sub_system", columns, rows, onConflict)
+}
+
+/// Creation times are buffered, and written dbChunkSize at a time in one
+/// transaction. Flush writes the rest.
+func (target *dbTarget) SetCreationTime(logID int64, timeCreated string) error {
+	target.creationMutex.Lock()
+	target.creationTimes = append(target.creationTimes, creationTime{logID: logID, timeCreated: timeCreated})
+	full := len(target.creationTimes) >= dbChunkSize
+	target.creationMutex.Unlock()
+	if full {
+		return target.Flush()
+	}
+	return nil
+}
+
+func (target *dbTarget) Flush() error {
+	target.creationMutex.Lock()
+	defer target.creationMutex.Unlock()
+	if len(target.creationTimes) == 0 {
+		return nil
+	}
+	err := target.inTransaction(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare("UPDATE log SET creation_time=? WHERE log_id=?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, entry := range target.creationTimes {
+			if _, err := stmt.Exec(entry.timeCreated, entry.logID); err != nil {
+				return fmt.Errorf("setting creation time of log %d: %s", entry.logID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	target.creationTimes = target.creationTimes[:0]
+	return nil
+}
+
+/// Migration batches go into their own table, which Jiskefet itself doesn't
+/// know about. It's created by the first migration that records a batch.
+func (target *dbTarget) StartBatch(batch batchInfo) error {
+	_, err := target.db.Exec("CREATE TABLE IF NOT EXISTS migration_batch(" +
+		"batch_id VARCHAR(64) NOT NULL PRIMARY KEY, " +
+		"started_at DATETIME NOT NULL, " +
+		"finished_at DATETIME NULL, " +
+		"status VARCHAR(16) NOT NULL, " +
+		"flags TEXT, " +
+		"source_db VARCHAR(255), " +
+		"counts TEXT, " +
+		"tool_version VARCHAR(64), " +
+		"operator VARCHAR(128))")
+	if err != nil {
+		return err
+	}
+	// A batch that is continued keeps its original start
+	_, err = target.db.Exec("INSERT INTO migration_batch(batch_id, started_at, status, flags, source_db, tool_version, operator) "+
+		"VALUES(?,?,?,?,?,?,?) ON DUPLICATE KEY UPDATE status=VALUES(status), flags=VALUES(flags), "+
+		"tool_version=VALUES(tool_version), operator=VALUES(operator)",
+		batch.ID, batch.Started, batch.Status, batch.Flags, batch.SourceDB, batch.Version, batch.Operator)
+	return err
+}
+
+func (target *dbTarget) FinishBatch(batch batchInfo) error {
+	_, err := target.db.Exec("UPDATE migration_batch SET finished_at=?, status=?, counts=? WHERE batch_id=?",
+		batch.Finished, batch.Status, batch.Counts, batch.ID)
+	return err
+}
+
+func (target *dbTarget) Close() error {
+	return target.Flush()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/// Writes every operation as one JSON object per line to a file, for
+/// migrating into an environment we can't reach from here, or to inspect what
+/// a migration would do. IDs are assigned by the file target itself, starting
+/// from 1. Later runs append to the file, and carry on from its highest IDs,
+/// so the IDs in an ID map stay valid.
+type fileTarget struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	nextID map[string]int64 // Kind of record -> next ID
+}
+
+/// One line of the file
+type fileRecord struct {
+	Op     string      `json:"op"`
+	ID     int64       `json:"id,omitempty"`
+	LogID  int64       `json:"logId,omitempty"`
+	Tag    string      `json:"tag,omitempty"`
+	Time   string      `json:"time,omitempty"`
+	Title  string      `json:"title,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Object interface{} `json:"object,omitempty"`
+}
+
+/// Operations that get a new ID -> kind of ID
+var fileIDKinds = map[string]string{
+	"createLog":     "log",
+	"createComment": "log",
+	"attachFile":    "attachment",
+}
+
+func newFileTarget(path string) *fileTarget {
+	nextID := lastFileIDs(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	check(err)
+	return &fileTarget{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		nextID: nextID,
+	}
+}
+
+/// Returns the highest ID of each kind in the file of an earlier run
+func lastFileIDs(path string) map[string]int64 {
+	last := make(map[string]int64)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return last
+	}
+	check(err)
+	defer file.Close()
+
+	reader := bufio.NewReader(file) // Lines with attachments are too long for a Scanner
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record struct {
+				Op string `json:"op"`
+				ID int64  `json:"id"`
+			}
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				panic(fmt.Sprintf("Target file \"%s\" has an invalid line, not appending to it: %s", path, jsonErr))
+			}
+			if kind, hasID := fileIDKinds[record.Op]; hasID && record.ID > last[kind] {
+				last[kind] = record.ID
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		check(err)
+	}
+	if len(last) > 0 {
+		log.Printf("Appending to target file \"%s\", carrying on from IDs %v\n", path, last)
+	}
+	return last
+}
+
+/// Writes the record, assigning it a new ID if its operation creates something
+func (target *fileTarget) write(record fileRecord) (int64, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if kind, hasID := fileIDKinds[record.Op]; hasID {
+		target.nextID[kind]++
+		record.ID = target.nextID[kind]
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := target.writer.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return record.ID, nil
+}
+
+func (target *fileTarget) CreateLog(entry TargetLog) (int64, error) {
+	return target.write(fileRecord{Op: "createLog", Object: entry})
+}
+
+func (target *fileTarget) CreateComment(entry TargetLog) (int64, error) {
+	return target.write(fileRecord{Op: "createComment", Object: entry})
+}
+
+func (target *fileTarget) CreateRun(run TargetRun) (int64, error) {
+	runNumber, err := strconv.ParseInt(run.RunNumber, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	_, err = target.write(fileRecord{Op: "createRun", ID: runNumber, Object: run})
+	return runNumber, err
+}
+
+func (target *fileTarget) AttachFile(logID int64, attachment TargetAttachment) (int64, error) {
+	return target.write(fileRecord{Op: "attachFile", LogID: logID, Object: attachment})
+}
+
+func (target *fileTarget) LinkTag(logID int64, tagText string) error {
+	_, err := target.write(fileRecord{Op: "linkTag", LogID: logID, Tag: tagText})
+	return err
+}
+
+func (target *fileTarget) UnlinkTag(logID int64, tagText string) error {
+	_, err := target.write(fileRecord{Op: "unlinkTag", LogID: logID, Tag: tagText})
+	return err
+}
+
+func (target *fileTarget) UpdateLog(logID int64, title string, body string) error {
+	_, err := target.write(fileRecord{Op: "updateLog", LogID: logID, Title: title, Body: body})
+	return err
+}
+
+/// The file can't know what is in Jiskefet, so every user and subsystem counts as inserted
+func (target *fileTarget) UpsertUsers(users []TargetUser, onConflict string) ([]UpsertResult, error) {
+	results := make([]UpsertResult, len(users))
+	for i, user := range users {
+		if _, err := target.write(fileRecord{Op: "upsertUser", ID: user.ID, Object: user}); err != nil {
+			return nil, err
+		}
+		results[i] = UpsertResult{Outcome: upsertInserted}
+	}
+	return results, nil
+}
+
+func (target *fileTarget) UpsertSubsystems(subsystems []TargetSubsystem, onConflict string) ([]UpsertResult, error) {
+	results := make([]UpsertResult, len(subsystems))
+	for i, subsystem := range subsystems {
+		if _, err := target.write(fileRecord{Op: "upsertSubsystem", ID: subsystem.ID, Object: subsystem}); err != nil {
+			return nil, err
+		}
+		results[i] = UpsertResult{Outcome: upsertInserted}
+	}
+	return results, nil
+}
+
+func (target *fileTarget) SetCreationTime(logID int64, timeCreated string) error {
+	_, err := target.write(fileRecord{Op: "setCreationTime", LogID: logID, Time: timeCreated})
+	return err
+}
+
+func (target *fileTarget) StartBatch(batch batchInfo) error {
+	_, err := target.write(fileRecord{Op: "startBatch", Object: batch})
+	return err
+}
+
+func (target *fileTarget) FinishBatch(batch batchInfo) error {
+	_, err := target.write(fileRecord{Op: "finishBatch", Object: batch})
+	return err
+}
+
+func (target *fileTarget) Flush() error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	return target.writer.Flush()
+}
+
+func (target *fileTarget) Close() error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+	if err := target.writer.Flush(); err != nil {
+		return err
+	}
+	return target.file.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+// What happens to comments that can't be reached from a thread root, because
+// their parent doesn't exist, or because their parents loop. A loop is broken
+// at its lowest comment ID, which is then handled like an orphan.
+const (
+	orphansPromote    = "promote"    // Orphan becomes the root of its own thread
+	orphansRoot       = "root"       // Orphan is a reply to its root parent, or promoted if that is unusable
+	orphansQuarantine = "quarantine" // Orphan and its replies are not migrated, only reported
+)
+
+func checkOrphansMode(mode string) {
+	switch mode {
+	case orphansPromote, orphansRoot, orphansQuarantine:
+		return
+	}
+	panic(fmt.Sprintf("Unknown orphans mode \"%s\", expected %s, %s or %s",
+		mode, orphansPromote, orphansRoot, orphansQuarantine))
+}
+
+/// The comment threads to migrate, built once from the parent links of all
+/// comments. Every comment is in at most one thread, and threads have no loops.
+type threadForest struct {
+	roots       []int64           // Thread roots, in ID order
+	children    map[int64][]int64 // Comment ID -> IDs of its replies
+	quarantined []int64           // Tops of the quarantined subthreads
+}
+
+/// Builds the threads, applying the orphans mode to comments that can't be
+/// reached from a root. Every orphan is logged and added to the report.
+func buildThreadForest(args Args, links []logbook.CommentLink, mode string) *threadForest {
+	forest := &threadForest{
+		roots:       make([]int64, 0),
+		children:    make(map[int64][]int64),
+		quarantined: make([]int64, 0),
+	}
+	byID := make(map[int64]logbook.CommentLink)
+	for _, link := range links {
+		byID[link.ID] = link
+	}
+	for _, link := range links {
+		if !link.Parent.Valid {
+			forest.roots = append(forest.roots, link.ID)
+		} else if _, exists := byID[link.Parent.Int64]; exists {
+			forest.children[link.Parent.Int64] = append(forest.children[link.Parent.Int64], link.ID)
+		}
+	}
+
+	// Everything reachable from a root is in a proper thread
+	placed := make(map[int64]bool)
+	for _, rootID := range forest.roots {
+		forest.mark(rootID, placed)
+	}
+
+	// What's left hangs below a missing parent or a loop. Find the top of each
+	// such subthread and place it according to the mode. A root parent that is
+	// quarantined is as unusable as a missing one.
+	quarantined := make(map[int64]bool)
+	for _, link := range links {
+		if placed[link.ID] {
+			continue
+		}
+		topID, problem := forest.detachedTop(byID, link.ID)
+		top := byID[topID]
+		if problem == "cycle" {
+			forest.unlink(top.Parent.Int64, topID)
+		}
+
+		action := mode
+		if mode == orphansRoot {
+			rootParentID := top.RootParent.Int64
+			if top.RootParent.Valid && rootParentID != topID && placed[rootParentID] && !quarantined[rootParentID] {
+				forest.children[rootParentID] = append(forest.children[rootParentID], topID)
+			} else {
+				log.Printf("WARNING: Root parent of comment %d is unusable, promoting it\n", topID)
+				action = orphansPromote
+			}
+		}
+		if action == orphansPromote {
+			forest.roots = append(forest.roots, topID)
+		}
+		if action == orphansQuarantine {
+			forest.quarantined = append(forest.quarantined, topID)
+		}
+
+		comments := forest.mark(topID, placed)
+		if action == orphansQuarantine {
+			for _, id := range comments {
+				quarantined[id] = true
+			}
+		}
+		log.Printf("WARNING: Comment %d (%s, %d comments in subthread): %s\n", topID, problem, len(comments), action)
+		args.report.addOrphanedThread(topID, top.Parent.Int64, problem, action, comments)
+	}
+	return forest
+}
+
+/// Marks the comment and its replies as placed, and returns their IDs.
+/// Iterative, and stops at comments that are already placed.
+func (forest *threadForest) mark(id int64, placed map[int64]bool) []int64 {
+	marked := make([]int64, 0)
+	stack := []int64{id}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if placed[current] {
+			continue
+		}
+		placed[current] = true
+		marked = append(marked, current)
+		stack = append(stack, forest.children[current]...)
+	}
+	return marked
+}
+
+/// Returns the IDs of the comments in the thread of the given root
+func (forest *threadForest) members(rootID int64) []int64 {
+	return forest.mark(rootID, make(map[int64]bool))
+}
+
+/// Follows the parents of a comment that can't be reached from a root.
+/// Returns the comment whose parent is missing ("orphan"), or the lowest
+/// comment ID of the loop the parents end up in ("cycle").
+func (forest *threadForest) detachedTop(byID map[int64]logbook.CommentLink, id int64) (int64, string) {
+	seen := make(map[int64]int) // Comment ID -> position in path
+	path := make([]int64, 0)
+	for current := id; ; {
+		if position, exists := seen[current]; exists {
+			lowest := current
+			for _, loopID := range path[position:] {
+				if loopID < lowest {
+					lowest = loopID
+				}
+			}
+			return lowest, "cycle"
+		}
+		seen[current] = len(path)
+		path = append(path, current)
+
+		parent, exists := byID[byID[current].Parent.Int64]
+		if !exists {
+			return current, "orphan"
+		}
+		current = parent.ID
+	}
+}
+
+/// Removes a reply from its parent
+func (forest *threadForest) unlink(parentID int64, childID int64) {
+	children := forest.children[parentID]
+	for i, id := range children {
+		if id == childID {
+			forest.children[parentID] = append(children[:i:i], children[i+1:]...)
+			return
+		}
+	}
+}
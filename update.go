@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// What a comment was migrated as, to find out later if it was edited in the
+/// logbook, and what changed. The body is only kept as a hash, to keep the ID
+/// map small.
+type logContents struct {
+	Title     string   `json:"title"`
+	TitleHash string   `json:"titleHash"` // Only in ID maps from before titles were recorded
+	BodyHash  string   `json:"bodyHash"`
+	Tags      []string `json:"tags"`
+}
+
+func hashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func contentsOf(title string, body string, tagTexts []string) logContents {
+	return logContents{
+		Title:    title,
+		BodyHash: hashText(body),
+		Tags:     tagTexts,
+	}
+}
+
+/// Whether the title differs, also for contents recorded as a hash only
+func (contents logContents) titleChanged(previous logContents) bool {
+	if previous.TitleHash != "" {
+		return hashText(contents.Title) != previous.TitleHash
+	}
+	return contents.Title != previous.Title
+}
+
+/// Returns the tags that are in a but not in b
+func missingTagTexts(a []string, b []string) []string {
+	inB := make(map[string]bool)
+	for _, tagText := range b {
+		inB[tagText] = true
+	}
+	missing := make([]string, 0)
+	for _, tagText := range a {
+		if !inB[tagText] {
+			missing = append(missing, tagText)
+		}
+	}
+	return missing
+}
+
+/// Looks for edits to the comments in the ID map, and updates their logs in
+/// Jiskefet: title and body, and the tags for type, class, context and
+/// subsystems. Comments migrated before contents were recorded have nothing
+/// to compare with, for those the current contents are recorded. The comments
+/// and their subsystems are read in one go, sync does this every pass.
+func updateLogbookComments(args Args, source logbook.Source, target Target, subsystems *subsystemTree) {
+	ids := args.idMap
+	comments := make(map[int64]logbook.Comment)
+	for _, comment := range source.Comments() {
+		comments[comment.ID.Int64] = comment
+	}
+	commentSubsystems := make(map[int64][]int64) // Comment ID -> subsystem IDs
+	for _, link := range source.SubsystemLinks() {
+		commentSubsystems[link.CommentID.Int64] = append(commentSubsystems[link.CommentID.Int64], link.SubsystemID.Int64)
+	}
+
+	updated := 0
+	for _, logbookID := range ids.logbookIDs() {
+		jiskefetID, _, _ := ids.logIDs(logbookID)
+		comment, exists := comments[logbookID]
+		if !exists {
+			log.Printf("WARNING: Comment %d is no longer in the logbook, not updated\n", logbookID)
+			continue
+		}
+		if args.anonymiser != nil {
+			comment = args.anonymiser.Comment(comment)
+		}
+		current := contentsOf(comment.Title.String, comment.Comment.String,
+			tagTextsOf(args, subsystems, comment, commentSubsystems[logbookID]))
+
+		previous, recorded := ids.contents(logbookID)
+		if !recorded {
+			log.Printf("No recorded contents for comment %d, recording the current ones\n", logbookID)
+			ids.setContents(logbookID, current)
+			continue
+		}
+
+		change := UpdatedLog{
+			LogbookID:   logbookID,
+			LogID:       jiskefetID,
+			Changed:     make([]string, 0),
+			TagsBefore:  previous.Tags,
+			TagsAfter:   current.Tags,
+			TagsAdded:   missingTagTexts(current.Tags, previous.Tags),
+			TagsRemoved: missingTagTexts(previous.Tags, current.Tags),
+		}
+		if current.titleChanged(previous) {
+			change.Changed = append(change.Changed, "title")
+			change.TitleBefore = previous.Title // Empty if only its hash was recorded
+			change.TitleAfter = current.Title
+		}
+		if current.BodyHash != previous.BodyHash {
+			change.Changed = append(change.Changed, "body")
+		}
+		if len(change.Changed) == 0 && len(change.TagsAdded) == 0 && len(change.TagsRemoved) == 0 {
+			continue
+		}
+
+		log.Printf("Updating comment %d (Jiskefet.ID=%d): changed %v, tags added %v, removed %v\n",
+			logbookID, jiskefetID, change.Changed, change.TagsAdded, change.TagsRemoved)
+		var err error
+		if len(change.Changed) > 0 {
+			err = target.UpdateLog(jiskefetID, comment.Title.String, comment.Comment.String)
+		}
+		for _, tagText := range change.TagsAdded {
+			if err == nil {
+				if err = target.LinkTag(jiskefetID, tagText); err == nil {
+					ids.addTagLink(jiskefetID, tagText)
+				}
+			}
+		}
+		for _, tagText := range change.TagsRemoved {
+			if err == nil {
+				err = target.UnlinkTag(jiskefetID, tagText)
+			}
+		}
+		if err != nil {
+			// Keep the old contents, so it's tried again next time
+			log.Printf("WARNING: Comment %d not updated: %s\n", logbookID, err)
+			change.Error = err.Error()
+		} else {
+			ids.setContents(logbookID, current)
+			updated++
+		}
+		args.report.addUpdatedLog(change)
+	}
+	log.Printf("Updated %d comments\n", updated)
+}
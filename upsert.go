@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// What happens to a user or subsystem that is in Jiskefet already, with other
+// data than the logbook has
+const (
+	conflictKeep      = "keep"      // Jiskefet's data stays, the conflict is reported
+	conflictOverwrite = "overwrite" // The logbook's data replaces Jiskefet's, the conflict is reported
+	conflictFail      = "fail"      // The migration stops, nothing of the stage is written
+)
+
+// What an upsert did with a row
+const (
+	upsertInserted    = "inserted"
+	upsertDuplicate   = "duplicate"   // In Jiskefet already, with the same data
+	upsertKept        = "kept"        // In Jiskefet already with other data, which was kept
+	upsertOverwritten = "overwritten" // In Jiskefet already with other data, which was overwritten
+)
+
+func checkConflictMode(mode string) {
+	switch mode {
+	case conflictKeep, conflictOverwrite, conflictFail:
+	default:
+		panic(fmt.Sprintf("Unknown conflict mode \"%s\", expected %s, %s or %s",
+			mode, conflictKeep, conflictOverwrite, conflictFail))
+	}
+}
+
+/// What an upsert did with one user or subsystem
+type UpsertResult struct {
+	Outcome     string            `json:"outcome"`               // See upsertInserted etc.
+	Differences []FieldDifference `json:"differences,omitempty"` // Only for conflicts
+}
+
+/// A column where Jiskefet has other data than the logbook
+type FieldDifference struct {
+	Field    string `json:"field"`
+	Existing string `json:"existing"`
+	Incoming string `json:"incoming"`
+}
+
+func (difference FieldDifference) String() string {
+	return fmt.Sprintf("%s \"%s\" instead of \"%s\"", difference.Field, difference.Existing, difference.Incoming)
+}
+
+/// Returned by upserts with conflictFail, for the first conflicting row
+type upsertConflictError struct {
+	Kind        string // "user" or "subsystem"
+	ID          int64
+	Differences []FieldDifference
+}
+
+func (err *upsertConflictError) Error() string {
+	return fmt.Sprintf("%s %d is in Jiskefet already with other data: %s",
+		err.Kind, err.ID, joinDifferences(err.Differences))
+}
+
+func joinDifferences(differences []FieldDifference) string {
+	texts := make([]string, len(differences))
+	for i, difference := range differences {
+		texts[i] = difference.String()
+	}
+	return strings.Join(texts, ", ")
+}
+
+/// Logs what an upsert did with a user or subsystem, and reports it.
+/// Returns whether it was inserted.
+func recordUpsert(args Args, kind string, id int64, name string, result UpsertResult) bool {
+	switch result.Outcome {
+	case upsertInserted:
+		log.Printf("Inserted %s \"%s\" (ID %d)\n", kind, name, id)
+		return true
+	case upsertDuplicate:
+		log.Printf("Already in Jiskefet: %s \"%s\" (ID %d)\n", kind, name, id)
+		args.report.addUpsertDuplicate(kind, id)
+	default:
+		log.Printf("WARNING: Already in Jiskefet with other data: %s \"%s\" (ID %d) has %s, %s\n",
+			kind, name, id, joinDifferences(result.Differences), result.Outcome)
+		args.report.addUpsertConflict(kind, id, result)
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// One entry of the explicit user merge list: the logbook users in From all
+/// end up as the logbook user Into in Jiskefet.
+/// An entry that merges a user into itself keeps that user separate, which
+/// can be used to override a wrongly detected duplicate.
+/// Example file:
+///   [{"into": 3, "from": [12, 45]}, {"into": 7, "from": [7]}]
+type UserMerge struct {
+	Into int64   `json:"into"`
+	From []int64 `json:"from"`
+}
+
+func loadUserMerges(path string) []UserMerge {
+	data, err := ioutil.ReadFile(path)
+	check(err)
+	merges := make([]UserMerge, 0)
+	check(json.Unmarshal(data, &merges))
+	return merges
+}
+
+/// Normalizes an email address or name for comparison
+func normalizeIdentity(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+/// Finds users that are likely the same person, because they share an email
+/// address or full name. Returns a map of duplicate user ID -> canonical user
+/// ID, where the canonical user is the one with the lowest ID in the group.
+func detectDuplicateUsers(users []logbook.User) map[int64]int64 {
+	// Union-find over user IDs
+	parent := make(map[int64]int64)
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+	union := func(a int64, b int64) {
+		rootA, rootB := find(a), find(b)
+		if rootA < rootB {
+			parent[rootB] = rootA
+		} else if rootB < rootA {
+			parent[rootA] = rootB
+		}
+	}
+
+	firstByKey := make(map[string]int64) // "email:..." or "name:..." -> first user ID seen
+	for _, user := range users {
+		parent[user.ID.Int64] = user.ID.Int64
+	}
+	for _, user := range users {
+		keys := make([]string, 0, 2)
+		if email := normalizeIdentity(user.Email.String); email != "" {
+			keys = append(keys, "email:"+email)
+		}
+		if name := normalizeIdentity(user.FullName.String); name != "" {
+			keys = append(keys, "name:"+name)
+		}
+		for _, key := range keys {
+			if other, exists := firstByKey[key]; exists {
+				union(user.ID.Int64, other)
+			} else {
+				firstByKey[key] = user.ID.Int64
+			}
+		}
+	}
+
+	duplicates := make(map[int64]int64)
+	for id := range parent {
+		if root := find(id); root != id {
+			duplicates[id] = root
+		}
+	}
+	return duplicates
+}
+
+/// Builds the map of logbook user ID -> logbook user ID it is merged into.
+/// Likely duplicates are always logged, but only merged if autoMerge is set.
+/// Entries from the merge file take precedence over detected duplicates, and
+/// must merge into users that exist.
+func buildUserMerges(users []logbook.User, mergeFile string, autoMerge bool) map[int64]int64 {
+	merges := make(map[int64]int64)
+	known := make(map[int64]bool)
+	for _, user := range users {
+		known[user.ID.Int64] = true
+	}
+
+	detected := detectDuplicateUsers(users)
+	for _, id := range sortedKeys(detected) {
+		log.Printf("Possible duplicate user %d of user %d\n", id, detected[id])
+		if autoMerge {
+			merges[id] = detected[id]
+		}
+	}
+
+	if mergeFile != "" {
+		log.Printf("Reading user merge list \"%s\"\n", mergeFile)
+		unknown := make([]string, 0)
+		for _, merge := range loadUserMerges(mergeFile) {
+			if !known[merge.Into] {
+				// Authors would end up as a user that is never migrated
+				unknown = append(unknown, strconv.FormatInt(merge.Into, 10))
+				continue
+			}
+			for _, from := range merge.From {
+				if !known[from] {
+					log.Printf("WARNING: User merge list merges unknown user %d into user %d\n", from, merge.Into)
+				}
+				merges[from] = merge.Into
+			}
+		}
+		if len(unknown) > 0 {
+			log.Panicf("User merge list \"%s\" merges into unknown users %s", mergeFile, strings.Join(unknown, ", "))
+		}
+	}
+
+	// Follow chains (a -> b -> c) so every user points at its final identity
+	resolved := make(map[int64]int64)
+	for _, from := range sortedKeys(merges) {
+		into := from
+		seen := map[int64]bool{}
+		for {
+			next, exists := merges[into]
+			if !exists || next == into {
+				break
+			}
+			if seen[next] {
+				log.Panicf("User merge list contains a cycle involving user %d", from)
+			}
+			seen[next] = true
+			into = next
+		}
+		if into != from {
+			resolved[from] = into
+			log.Printf("Merging user %d into user %d\n", from, into)
+		}
+	}
+	return resolved
+}
+
+/// Returns the user ID the given logbook user should be migrated as
+func canonicalUserID(args Args, userID int64) int64 {
+	if into, merged := args.userMerges[userID]; merged {
+		return into
+	}
+	return userID
+}
+
+func sortedKeys(m map[int64]int64) []int64 {
+	keys := make([]int64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
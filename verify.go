@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/SoftwareForScience/jiskefet-migrate-logbook/logbook"
+)
+
+/// What verify found: things the ID map says were migrated but that are not
+/// in Jiskefet, and logbook comments that were never migrated, e.g. because
+/// they were filtered out or quarantined
+type Verification struct {
+	Generated          string   `json:"generated"`
+	MissingLogs        []int64  `json:"missingLogs"`        // Logbook comment IDs
+	MissingAttachments []int64  `json:"missingAttachments"` // Logbook file IDs
+	MissingRuns        []string `json:"missingRuns"`        // Logbook run numbers
+	NotMigrated        []int64  `json:"notMigrated"`        // Logbook comment IDs
+}
+
+/// Checks the ID map against the Jiskefet DB and the logbook
+func verifyMigration(args Args, source logbook.Source, jiskefetDB *sql.DB) *Verification {
+	ids := args.idMap
+	if ids.Target == targetFile {
+		panic("The ID map is for the file target, there is nothing in Jiskefet to verify")
+	}
+	verification := &Verification{
+		Generated:          time.Now().UTC().Format(time.RFC3339),
+		MissingLogs:        make([]int64, 0),
+		MissingAttachments: make([]int64, 0),
+		MissingRuns:        make([]string, 0),
+		NotMigrated:        make([]int64, 0),
+	}
+
+	logs := existingIDs(jiskefetDB, "log", "log_id", ids.Logs)
+	for _, logbookID := range sortedKeys(ids.Logs) {
+		if !logs[ids.Logs[logbookID]] {
+			verification.MissingLogs = append(verification.MissingLogs, logbookID)
+			log.Printf("ERROR: Comment %d was migrated as log %d, which is not in Jiskefet\n", logbookID, ids.Logs[logbookID])
+		}
+	}
+
+	// Files the target skipped have no attachment to look for
+	attachmentIDs := make(map[int64]int64)
+	for fileID, attachmentID := range ids.Files {
+		if attachmentID != 0 {
+			attachmentIDs[fileID] = attachmentID
+		}
+	}
+	attachments := existingIDs(jiskefetDB, "attachment", "file_id", attachmentIDs)
+	for _, fileID := range sortedKeys(attachmentIDs) {
+		if !attachments[attachmentIDs[fileID]] {
+			verification.MissingAttachments = append(verification.MissingAttachments, fileID)
+			log.Printf("ERROR: File %d was migrated as attachment %d, which is not in Jiskefet\n", fileID, attachmentIDs[fileID])
+		}
+	}
+
+	runNumbers := make(map[int64]int64)
+	logbookRuns := make(map[int64]string)
+	for logbookRun, runNumber := range ids.Runs {
+		runNumbers[runNumber] = runNumber
+		logbookRuns[runNumber] = logbookRun
+	}
+	runs := existingIDs(jiskefetDB, "run", "run_number", runNumbers)
+	for _, runNumber := range sortedKeys(runNumbers) {
+		if !runs[runNumber] {
+			verification.MissingRuns = append(verification.MissingRuns, logbookRuns[runNumber])
+			log.Printf("ERROR: Run %s was migrated as run %d, which is not in Jiskefet\n", logbookRuns[runNumber], runNumber)
+		}
+	}
+
+	for _, link := range source.CommentLinks() {
+		if _, _, migrated := ids.logIDs(link.ID); !migrated {
+			verification.NotMigrated = append(verification.NotMigrated, link.ID)
+		}
+	}
+
+	log.Printf("Verified %d logs, %d attachments and %d runs: %d, %d and %d missing, %d comments not migrated\n",
+		len(ids.Logs), len(attachmentIDs), len(ids.Runs), len(verification.MissingLogs),
+		len(verification.MissingAttachments), len(verification.MissingRuns), len(verification.NotMigrated))
+	return verification
+}
+
+/// Returns which of the values of ids are in the column
+func existingIDs(jiskefetDB *sql.DB, table string, column string, ids map[int64]int64) map[int64]bool {
+	values := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, id)
+	}
+	rows, err := existingRows(jiskefetDB, table, []string{column}, values)
+	check(err)
+	existing := make(map[int64]bool)
+	for id := range rows {
+		existing[id] = true
+	}
+	return existing
+}
+
+/// Whether Jiskefet is missing anything the ID map has
+func (verification *Verification) failed() bool {
+	return len(verification.MissingLogs) > 0 || len(verification.MissingAttachments) > 0 ||
+		len(verification.MissingRuns) > 0
+}
+
+/// Writes the result to path, if given. Panics if Jiskefet is missing anything.
+func (verification *Verification) write(path string) {
+	if path != "" {
+		data, err := json.MarshalIndent(verification, "", "  ")
+		check(err)
+		check(ioutil.WriteFile(path, data, 0644))
+		log.Printf("Wrote verification to \"%s\"\n", path)
+	}
+	if verification.failed() {
+		panic(fmt.Sprintf("Verification failed: %d logs, %d attachments and %d runs are missing in Jiskefet",
+			len(verification.MissingLogs), len(verification.MissingAttachments), len(verification.MissingRuns)))
+	}
+}